@@ -0,0 +1,283 @@
+// Package breaker implements circuit breaker tracking failure and slow call rates in sliding time window.
+package breaker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrOpen is returned by Allow when circuit breaker is open or has no half-open probes left.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State is state of circuit breaker.
+type State int
+
+const (
+	// Closed breaker lets all calls through.
+	Closed State = iota
+	// Open breaker rejects all calls until OpenTimeout passes.
+	Open
+	// HalfOpen breaker lets HalfOpenCalls probes through and decides whether to close or to open again by their results.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	defaultFailureRateThreshold = 0.5
+	defaultMinimumCalls         = 20
+	defaultWindow               = 10 * time.Second
+	defaultOpenTimeout          = 30 * time.Second
+	defaultHalfOpenCalls        = 5
+
+	windowBuckets = 10
+)
+
+// Config holds circuit breaker thresholds.
+type Config struct {
+	// FailureRateThreshold opens breaker when failed calls rate in the window reaches it, 0.5 by default.
+	FailureRateThreshold float64
+	// SlowCallDuration is duration of call considered slow, slow calls aren't tracked if zero.
+	SlowCallDuration time.Duration
+	// SlowCallRateThreshold opens breaker when slow calls rate in the window reaches it, 1 by default.
+	SlowCallRateThreshold float64
+	// MinimumCalls is number of calls in the window required to calculate rates, 20 by default.
+	MinimumCalls int
+	// Window is length of sliding window, 10s by default.
+	Window time.Duration
+	// OpenTimeout is how long breaker stays open before probing, 30s by default.
+	OpenTimeout time.Duration
+	// HalfOpenCalls is number of probes let through by half-open breaker, 5 by default.
+	HalfOpenCalls int
+}
+
+func (c *Config) withDefaults() {
+	if c.FailureRateThreshold <= 0 {
+		c.FailureRateThreshold = defaultFailureRateThreshold
+	}
+	if c.SlowCallRateThreshold <= 0 {
+		c.SlowCallRateThreshold = 1
+	}
+	if c.MinimumCalls <= 0 {
+		c.MinimumCalls = defaultMinimumCalls
+	}
+	if c.Window <= 0 {
+		c.Window = defaultWindow
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = defaultOpenTimeout
+	}
+	if c.HalfOpenCalls <= 0 {
+		c.HalfOpenCalls = defaultHalfOpenCalls
+	}
+}
+
+type counts struct {
+	calls, failures, slow int
+}
+
+func (c *counts) add(o counts) {
+	c.calls += o.calls
+	c.failures += o.failures
+	c.slow += o.slow
+}
+
+type bucket struct {
+	start time.Time
+	counts
+}
+
+type stateChange struct {
+	from, to State
+}
+
+// Breaker is circuit breaker, it is safe for concurrent use.
+type Breaker struct {
+	cfg      Config
+	onChange func(from, to State)
+
+	lock    sync.Mutex
+	state   State
+	since   time.Time
+	buckets [windowBuckets]bucket
+	// generation is incremented on every state change, so results of calls allowed in previous state are ignored
+	generation uint64
+	// probes are half-open calls let through, probeCounts are their results
+	probes      int
+	probeCounts counts
+	// changes are state changes to be notified, notifyLock serializes notifications in order of changes
+	changes    []stateChange
+	notifyLock sync.Mutex
+
+	now func() time.Time
+}
+
+// New creates closed Breaker, onChange is called on every state change in order of changes and may be nil.
+// onChange must not call the breaker.
+func New(cfg Config, onChange func(from, to State)) *Breaker {
+	cfg.withDefaults()
+	if onChange == nil {
+		onChange = func(from, to State) {}
+	}
+
+	return &Breaker{
+		cfg:      cfg,
+		onChange: onChange,
+		now:      time.Now,
+		since:    time.Now(),
+	}
+}
+
+// State returns current state of the breaker.
+func (b *Breaker) State() State {
+	b.lock.Lock()
+	state := b.currentLocked(b.now())
+	b.unlockAndNotify()
+	return state
+}
+
+// Allow checks if call may proceed and returns function to report its result.
+// It returns ErrOpen if breaker is open or all half-open probes are in flight.
+func (b *Breaker) Allow() (done func(failure bool, duration time.Duration), err error) {
+	b.lock.Lock()
+	now := b.now()
+	state := b.currentLocked(now)
+	generation := b.generation
+	switch state {
+	case Open:
+		err = ErrOpen
+	case HalfOpen:
+		if b.probes >= b.cfg.HalfOpenCalls {
+			err = ErrOpen
+		} else {
+			b.probes++
+		}
+	}
+	b.unlockAndNotify()
+
+	if err != nil {
+		return nil, err
+	}
+	return func(failure bool, duration time.Duration) {
+		b.done(generation, failure, duration)
+	}, nil
+}
+
+func (b *Breaker) done(generation uint64, failure bool, duration time.Duration) {
+	c := counts{calls: 1}
+	if failure {
+		c.failures = 1
+	}
+	if b.cfg.SlowCallDuration > 0 && duration >= b.cfg.SlowCallDuration {
+		c.slow = 1
+	}
+
+	b.lock.Lock()
+	now := b.now()
+	state := b.currentLocked(now)
+	if generation != b.generation {
+		b.unlockAndNotify()
+		return
+	}
+
+	switch state {
+	case Closed:
+		b.bucketLocked(now).add(c)
+		if total := b.totalLocked(now); b.exceeds(total, b.cfg.MinimumCalls) {
+			b.setStateLocked(Open, now)
+		}
+	case HalfOpen:
+		b.probeCounts.add(c)
+		if b.probeCounts.calls >= b.cfg.HalfOpenCalls {
+			if b.exceeds(b.probeCounts, b.cfg.HalfOpenCalls) {
+				b.setStateLocked(Open, now)
+			} else {
+				b.setStateLocked(Closed, now)
+			}
+		}
+	}
+	b.unlockAndNotify()
+}
+
+func (b *Breaker) exceeds(c counts, minimum int) bool {
+	if c.calls == 0 || c.calls < minimum {
+		return false
+	}
+	if float64(c.failures)/float64(c.calls) >= b.cfg.FailureRateThreshold {
+		return true
+	}
+	return b.cfg.SlowCallDuration > 0 && float64(c.slow)/float64(c.calls) >= b.cfg.SlowCallRateThreshold
+}
+
+// currentLocked moves open breaker to half-open once OpenTimeout passes.
+func (b *Breaker) currentLocked(now time.Time) State {
+	if b.state == Open && now.Sub(b.since) >= b.cfg.OpenTimeout {
+		b.setStateLocked(HalfOpen, now)
+	}
+	return b.state
+}
+
+// setStateLocked changes state, the change is notified by unlockAndNotify.
+func (b *Breaker) setStateLocked(state State, now time.Time) {
+	b.changes = append(b.changes, stateChange{from: b.state, to: state})
+	b.state = state
+	b.since = now
+	b.generation++
+	b.probes = 0
+	b.probeCounts = counts{}
+	b.buckets = [windowBuckets]bucket{}
+}
+
+// unlockAndNotify releases lock and calls onChange for state changes made under it.
+// Changes are taken under notifyLock, so concurrent notifications don't overtake each other.
+func (b *Breaker) unlockAndNotify() {
+	pending := len(b.changes) > 0
+	b.lock.Unlock()
+	if !pending {
+		return
+	}
+
+	b.notifyLock.Lock()
+	defer b.notifyLock.Unlock()
+	b.lock.Lock()
+	changes := b.changes
+	b.changes = nil
+	b.lock.Unlock()
+
+	for _, c := range changes {
+		b.onChange(c.from, c.to)
+	}
+}
+
+func (b *Breaker) bucketLocked(now time.Time) *bucket {
+	width := b.cfg.Window / windowBuckets
+	start := now.Truncate(width)
+	bkt := &b.buckets[(start.UnixNano()/int64(width))%windowBuckets]
+	if !bkt.start.Equal(start) {
+		*bkt = bucket{start: start}
+	}
+	return bkt
+}
+
+func (b *Breaker) totalLocked(now time.Time) counts {
+	var total counts
+	for _, bkt := range b.buckets {
+		if now.Sub(bkt.start) < b.cfg.Window {
+			total.add(bkt.counts)
+		}
+	}
+	return total
+}
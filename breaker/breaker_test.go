@@ -0,0 +1,216 @@
+package breaker
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBreaker is breaker with manual clock recording its state changes.
+type testBreaker struct {
+	*Breaker
+	clock time.Time
+
+	mu      sync.Mutex
+	changes []stateChange
+}
+
+func newTestBreaker(cfg Config) *testBreaker {
+	tb := &testBreaker{clock: time.Unix(1000, 0)}
+	tb.Breaker = New(cfg, func(from, to State) {
+		tb.mu.Lock()
+		tb.changes = append(tb.changes, stateChange{from: from, to: to})
+		tb.mu.Unlock()
+	})
+	tb.now = func() time.Time { return tb.clock }
+	tb.since = tb.clock
+	return tb
+}
+
+func (tb *testBreaker) advance(d time.Duration) {
+	tb.clock = tb.clock.Add(d)
+}
+
+func (tb *testBreaker) recorded() []stateChange {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return append([]stateChange(nil), tb.changes...)
+}
+
+// call makes call through breaker with result failure and duration.
+func (tb *testBreaker) call(t *testing.T, failure bool, duration time.Duration) {
+	t.Helper()
+	done, err := tb.Allow()
+	if err != nil {
+		t.Fatalf("Allow() = %v in %s state, want nil", err, tb.State())
+	}
+	done(failure, duration)
+}
+
+func (tb *testBreaker) open(t *testing.T) {
+	t.Helper()
+	for i := 0; i < tb.cfg.MinimumCalls; i++ {
+		tb.call(t, true, 0)
+	}
+	if st := tb.State(); st != Open {
+		t.Fatalf("State() = %s after failed calls, want open", st)
+	}
+}
+
+func expectState(t *testing.T, b *testBreaker, want State) {
+	t.Helper()
+	if st := b.State(); st != want {
+		t.Fatalf("State() = %s, want %s", st, want)
+	}
+}
+
+func TestOpenOnFailureRate(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 4, FailureRateThreshold: 0.5})
+
+	b.call(t, false, 0)
+	b.call(t, false, 0)
+	b.call(t, true, 0)
+	expectState(t, b, Closed)
+	b.call(t, true, 0)
+	expectState(t, b, Open)
+
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Errorf("Allow() = %v in open state, want ErrOpen", err)
+	}
+	if changes := b.recorded(); len(changes) != 1 || changes[0] != (stateChange{from: Closed, to: Open}) {
+		t.Errorf("changes = %v, want closed to open", changes)
+	}
+}
+
+func TestFailuresOutOfWindow(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 4, Window: 10 * time.Second})
+
+	b.call(t, true, 0)
+	b.call(t, true, 0)
+	b.call(t, true, 0)
+	b.advance(11 * time.Second)
+	b.call(t, true, 0)
+	expectState(t, b, Closed)
+}
+
+func TestOpenOnSlowCallRate(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 4, SlowCallDuration: time.Second, SlowCallRateThreshold: 0.5})
+
+	b.call(t, false, 10*time.Millisecond)
+	b.call(t, false, 10*time.Millisecond)
+	b.call(t, false, 2*time.Second)
+	expectState(t, b, Closed)
+	b.call(t, false, time.Second)
+	expectState(t, b, Open)
+}
+
+func TestHalfOpenAfterOpenTimeout(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 2, OpenTimeout: 30 * time.Second})
+	b.open(t)
+
+	b.advance(29 * time.Second)
+	expectState(t, b, Open)
+	b.advance(time.Second)
+	expectState(t, b, HalfOpen)
+
+	want := []stateChange{{from: Closed, to: Open}, {from: Open, to: HalfOpen}}
+	changes := b.recorded()
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("changes = %v, want %v", changes, want)
+		}
+	}
+}
+
+func TestHalfOpenProbeLimit(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 2, HalfOpenCalls: 2})
+	b.open(t)
+	b.advance(b.cfg.OpenTimeout)
+
+	var probes []func(bool, time.Duration)
+	for i := 0; i < 2; i++ {
+		done, err := b.Allow()
+		if err != nil {
+			t.Fatalf("Allow() = %v for probe %d, want nil", err, i+1)
+		}
+		probes = append(probes, done)
+	}
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Errorf("Allow() = %v with all probes in flight, want ErrOpen", err)
+	}
+
+	for _, done := range probes {
+		done(false, 0)
+	}
+	expectState(t, b, Closed)
+}
+
+func TestHalfOpenToClosed(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 2, HalfOpenCalls: 2})
+	b.open(t)
+	b.advance(b.cfg.OpenTimeout)
+
+	b.call(t, false, 0)
+	expectState(t, b, HalfOpen)
+	b.call(t, false, 0)
+	expectState(t, b, Closed)
+}
+
+func TestHalfOpenToOpen(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 2, HalfOpenCalls: 2})
+	b.open(t)
+	b.advance(b.cfg.OpenTimeout)
+
+	b.call(t, true, 0)
+	b.call(t, false, 0)
+	expectState(t, b, Open)
+
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Errorf("Allow() = %v after failed probes, want ErrOpen", err)
+	}
+}
+
+func TestResultOfPreviousStateIgnored(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 2, HalfOpenCalls: 1})
+	stale, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow() = %v, want nil", err)
+	}
+	b.open(t)
+	b.advance(b.cfg.OpenTimeout)
+	expectState(t, b, HalfOpen)
+
+	// call allowed while closed doesn't count as probe
+	stale(false, 0)
+	expectState(t, b, HalfOpen)
+}
+
+func TestConcurrentChangesInOrder(t *testing.T) {
+	b := newTestBreaker(Config{MinimumCalls: 1, HalfOpenCalls: 1, OpenTimeout: time.Nanosecond})
+	b.now = time.Now
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if done, err := b.Allow(); err == nil {
+					done((i+j)%2 == 0, 0)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	state := Closed
+	for _, c := range b.recorded() {
+		if c.from != state {
+			t.Fatalf("change from %s to %s notified in %s state", c.from, c.to, state)
+		}
+		state = c.to
+	}
+}
@@ -29,7 +29,14 @@ var decodableType = reflect.ValueOf((*Decodable)(nil)).Type().Elem()
 type Config struct {
 	v       *viper.Viper
 	lock    sync.RWMutex
-	watches map[string]func()
+	watches []*watch
+}
+
+// watch is a subscription to changes of a configuration key.
+type watch struct {
+	key      string
+	last     interface{}
+	callback func()
 }
 
 type Loader interface {
@@ -73,19 +80,42 @@ func Configure() *Config {
 	}
 
 	cfg.v.WatchConfig()
-	cfg.v.OnConfigChange(func(_ fsnotify.Event) {
-		//TODO implement diff on current state and call watchers per config key
-	})
+	cfg.v.OnConfigChange(cfg.onChange)
 
 	return cfg
 }
 
+// Watch registers callback that is called every time value of the key is changed in the configuration file.
+// Callback is expected to Load the key again.
 func (c *Config) Watch(key string, callback func()) {
+	key = normalizeKey(key)
+
 	c.lock.Lock()
-	c.watches[key] = callback
+	c.watches = append(c.watches, &watch{key: key, last: c.v.Get(key), callback: callback})
 	c.lock.Unlock()
 }
 
+func (c *Config) onChange(_ fsnotify.Event) {
+	var changed []func()
+
+	c.lock.Lock()
+	for _, w := range c.watches {
+		raw := c.v.Get(w.key)
+		if reflect.DeepEqual(raw, w.last) {
+			continue
+		}
+
+		w.last = raw
+		changed = append(changed, w.callback)
+	}
+	c.lock.Unlock()
+
+	// callbacks are called outside of the lock so they are free to Load and Watch
+	for _, callback := range changed {
+		callback()
+	}
+}
+
 func (c *Config) MustLoad(key string, to interface{}) {
 	if err := c.Load(key, to); err != nil {
 		panic(err)
@@ -0,0 +1,62 @@
+// Package discovery holds types shared by service discovery resolvers and load balancers.
+package discovery
+
+import (
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// Service meta keys describing instance.
+const (
+	// MetaZone is availability zone of instance.
+	MetaZone = "zone"
+	// MetaWeight is relative weight of instance for weighted balancing, 1 by default.
+	MetaWeight = "weight"
+	// MetaVersion is version of instance.
+	MetaVersion = "version"
+)
+
+// Attributes describe instance behind resolved address, resolvers set them as resolver.Address Metadata.
+// Attributes are comparable, as balancers use addresses as map keys.
+type Attributes struct {
+	Zone    string
+	Weight  int
+	Version string
+	// Tags are comma separated tags of instance.
+	Tags string
+}
+
+// AttributesFromMeta parses Attributes from service meta and tags, invalid or missing weight is 1.
+func AttributesFromMeta(meta map[string]string, tags []string) Attributes {
+	weight, err := strconv.Atoi(meta[MetaWeight])
+	if err != nil || weight < 1 {
+		weight = 1
+	}
+
+	return Attributes{
+		Zone:    meta[MetaZone],
+		Weight:  weight,
+		Version: meta[MetaVersion],
+		Tags:    strings.Join(tags, ","),
+	}
+}
+
+// HasTag checks if instance is tagged by tag.
+func (a Attributes) HasTag(tag string) bool {
+	for _, t := range strings.Split(a.Tags, ",") {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AttributesOf returns Attributes of addr, addresses without them have weight 1.
+func AttributesOf(addr resolver.Address) Attributes {
+	if attrs, ok := addr.Metadata.(Attributes); ok {
+		return attrs
+	}
+	return Attributes{Weight: 1}
+}
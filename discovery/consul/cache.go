@@ -0,0 +1,84 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/humans-net/grpc-core/discovery"
+	"google.golang.org/grpc/grpclog"
+)
+
+type cachedState struct {
+	Instances     []discovery.Instance `json:"instances"`
+	ServiceConfig string               `json:"service_config,omitempty"`
+}
+
+// diskCache stores the last known instances of services as json files, nil diskCache stores nothing.
+type diskCache struct {
+	dir string
+}
+
+func (c *diskCache) path(key watcherKey) string {
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(key.address + "_" + key.service)
+	if key.tag != "" {
+		name += "_" + key.tag
+	}
+	return filepath.Join(c.dir, name+".json")
+}
+
+// store writes state atomically, so a crash doesn't leave broken cache behind.
+func (c *diskCache) store(key watcherKey, state cachedState) {
+	if c == nil {
+		return
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		grpclog.Errorf("failed to marshal cached instances of %s: %v", key, err)
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		grpclog.Errorf("failed to create consul cache dir %s: %v", c.dir, err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		grpclog.Errorf("failed to cache instances of %s: %v", key, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		grpclog.Errorf("failed to cache instances of %s: %v", key, err)
+	}
+}
+
+func (c *diskCache) load(key watcherKey) (cachedState, bool) {
+	var state cachedState
+	if c == nil {
+		return state, false
+	}
+
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			grpclog.Errorf("failed to read cached instances of %s: %v", key, err)
+		}
+		return state, false
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		grpclog.Errorf("failed to parse cached instances of %s: %v", key, err)
+		return state, false
+	}
+	return state, true
+}
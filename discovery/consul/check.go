@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// Check types.
+const (
+	// CheckGRPC is grpc health check of the service.
+	CheckGRPC = "grpc"
+	// CheckHTTP is http check of readiness endpoint.
+	CheckHTTP = "http"
+	// CheckTTL is check which status is reported by the service itself, see Registration.UpdateTTL.
+	CheckTTL = "ttl"
+)
+
+const (
+	defaultCheckInterval   = 10 * time.Second
+	defaultCheckTTL        = 30 * time.Second
+	defaultCheckPath       = "/readyz"
+	defaultDeregisterAfter = time.Minute
+)
+
+// CheckConfig configures consul health check of registered service.
+type CheckConfig struct {
+	// Type is one of grpc (default), http or ttl.
+	Type string
+	// Interval of grpc and http checks, 10s by default.
+	Interval time.Duration
+	// Timeout of grpc and http checks, consul default if zero.
+	Timeout time.Duration
+	// TLS makes grpc and http checks use TLS.
+	TLS bool
+	// TLSSkipVerify disables verification of service certificate.
+	TLSSkipVerify bool
+	// Path of http check, /readyz by default.
+	Path string
+	// TTL is how long TTL check stays passing without update, 30s by default.
+	TTL time.Duration
+	// DeregisterCriticalServiceAfter is how long service may stay critical before it is deregistered, 1m by default.
+	DeregisterCriticalServiceAfter time.Duration
+}
+
+func (c *CheckConfig) withDefaults() {
+	if c.Type == "" {
+		c.Type = CheckGRPC
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultCheckInterval
+	}
+	if c.Path == "" {
+		c.Path = defaultCheckPath
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultCheckTTL
+	}
+	if c.DeregisterCriticalServiceAfter <= 0 {
+		c.DeregisterCriticalServiceAfter = defaultDeregisterAfter
+	}
+}
+
+func (c *CheckConfig) agentCheck(name, checkID, addr string) (*api.AgentServiceCheck, error) {
+	check := &api.AgentServiceCheck{
+		CheckID: checkID,
+		Name:    fmt.Sprintf("%s %s check", name, c.Type),
+		// logout time, equivalent to expiration time
+		DeregisterCriticalServiceAfter: c.DeregisterCriticalServiceAfter.String(),
+	}
+	if c.Timeout > 0 {
+		check.Timeout = c.Timeout.String()
+	}
+
+	switch c.Type {
+	case CheckGRPC:
+		check.Interval = c.Interval.String()
+		// address to perform health check, service will be passed to HealthCheck function
+		check.GRPC = fmt.Sprintf("%v/%v", addr, name)
+		check.GRPCUseTLS = c.TLS
+		check.TLSSkipVerify = c.TLSSkipVerify
+	case CheckHTTP:
+		scheme := "http"
+		if c.TLS {
+			scheme = "https"
+		}
+		check.Interval = c.Interval.String()
+		check.HTTP = fmt.Sprintf("%s://%v%s", scheme, addr, c.Path)
+		check.TLSSkipVerify = c.TLSSkipVerify
+	case CheckTTL:
+		check.TTL = c.TTL.String()
+	default:
+		return nil, errors.Errorf("unknown check type %q", c.Type)
+	}
+
+	return check, nil
+}
@@ -3,4 +3,14 @@ package consul
 type Config struct {
 	Endpoint string
 	Name     string `key:"-"`
+	// Meta is service meta of registered instance, e.g. zone, weight and version used by balancers of clients.
+	Meta map[string]string
+	// Checks are health checks of registered instance, grpc check if empty.
+	Checks []CheckConfig
+	// Connect registers instance as Consul Connect native service. Server accepts mutual TLS with connect certificates
+	// only, authorizing clients by intentions, and clients dial consul resolved services with connect certificates.
+	// Agent has no connect certificate for grpc check, so http check is used by default.
+	Connect bool
+	// CacheDir is directory to persist the last known instances of services resolved by consul, nothing is persisted if empty.
+	CacheDir string
 }
@@ -0,0 +1,289 @@
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/grpclog"
+)
+
+// Connect provides certificates of Consul Connect native service and TLS configs using them.
+// Leaf certificate and CA roots are watched by blocking queries to agent, so rotated certificates are used right away.
+type Connect struct {
+	service string
+	agent   *api.Agent
+
+	lock        sync.RWMutex
+	cert        *tls.Certificate
+	validBefore time.Time
+	roots       *x509.CertPool
+	trustDomain string
+}
+
+// NewConnect loads certificates of service cfg.Name from consul agent and watches them until ctx is done.
+func NewConnect(ctx context.Context, cfg Config) (*Connect, error) {
+	consulConfig := api.DefaultConfig()
+	consulConfig.Address = cfg.Endpoint
+	client, err := api.NewClient(consulConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error create consul client")
+	}
+
+	c := &Connect{service: cfg.Name, agent: client.Agent()}
+	rootsIndex, err := c.loadRoots(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	leafIndex, err := c.loadLeaf(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	go c.watch(ctx, "CA roots", rootsIndex, c.loadRoots)
+	go c.watch(ctx, "leaf certificate", leafIndex, c.loadLeaf)
+
+	return c, nil
+}
+
+// watch reloads certificates by blocking query load until ctx is done.
+func (c *Connect) watch(ctx context.Context, name string, index uint64, load func(ctx context.Context, index uint64) (uint64, error)) {
+	backoff := minRetryBackoff
+	for {
+		lastIndex, err := load(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			grpclog.Errorf("error retrieving connect %s of %s from Consul, retrying in %s: %v", name, c.service, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+			continue
+		}
+		backoff = minRetryBackoff
+
+		// index going backwards means consul state was reset
+		if lastIndex < index {
+			lastIndex = 0
+		}
+		index = lastIndex
+	}
+}
+
+func (c *Connect) loadRoots(ctx context.Context, index uint64) (uint64, error) {
+	list, meta, err := c.agent.ConnectCARoots((&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get connect CA roots")
+	}
+	if meta.LastIndex == index {
+		return index, nil
+	}
+
+	roots := x509.NewCertPool()
+	for _, root := range list.Roots {
+		if !roots.AppendCertsFromPEM([]byte(root.RootCertPEM)) {
+			return 0, errors.Errorf("invalid connect CA root %s", root.ID)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.roots, c.trustDomain = roots, list.TrustDomain
+	grpclog.Infof("loaded %d connect CA roots of trust domain %s", len(list.Roots), list.TrustDomain)
+
+	return meta.LastIndex, nil
+}
+
+func (c *Connect) loadLeaf(ctx context.Context, index uint64) (uint64, error) {
+	leaf, meta, err := c.agent.ConnectCALeaf(c.service, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get connect leaf certificate")
+	}
+	if meta.LastIndex == index {
+		return index, nil
+	}
+
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid connect leaf certificate")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert, c.validBefore = &cert, leaf.ValidBefore
+	grpclog.Infof("loaded connect leaf certificate %s of %s valid before %s", leaf.SerialNumber, leaf.ServiceURI, leaf.ValidBefore)
+
+	return meta.LastIndex, nil
+}
+
+// Check fails if leaf certificate expired, e.g. it isn't rotated as consul agent is unreachable.
+func (c *Connect) Check(_ context.Context) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if time.Now().After(c.validBefore) {
+		return errors.Errorf("connect leaf certificate expired at %s", c.validBefore)
+	}
+	return nil
+}
+
+// ServerTLSConfig requires clients to present connect certificates and authorizes them by intentions of consul.
+// Calls of the service to itself, e.g. by http gateway, are always authorized.
+func (c *Connect) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.certificate()
+		},
+		// chain is verified by roots watched instead of static ClientCAs
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			leaf, err := c.verify(rawCerts)
+			if err != nil {
+				return err
+			}
+			return c.authorize(leaf)
+		},
+	}
+}
+
+// ClientTLSConfig presents connect certificate and verifies that server is instance of service.
+func (c *Connect) ClientTLSConfig(service string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// server name doesn't match consul address of instance, chain and service are verified by VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.certificate()
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			leaf, err := c.verify(rawCerts)
+			if err != nil {
+				return err
+			}
+			if name, ok := c.serviceOf(leaf); !ok || name != service {
+				return errors.Errorf("connect certificate %s doesn't belong to service %s", uriOf(leaf), service)
+			}
+			return nil
+		},
+	}
+}
+
+func (c *Connect) certificate() (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.cert == nil {
+		return nil, errors.New("connect leaf certificate isn't loaded")
+	}
+	return c.cert, nil
+}
+
+// verify verifies chain of peer certificates by connect CA roots and returns leaf certificate.
+func (c *Connect) verify(rawCerts [][]byte) (*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid peer certificate")
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	c.lock.RLock()
+	roots := c.roots
+	c.lock.RUnlock()
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify connect certificate")
+	}
+	return certs[0], nil
+}
+
+// IsSelf reports whether leaf certificate identifies the service itself, e.g. its grpc gateway calling it over loopback.
+func (c *Connect) IsSelf(leaf *x509.Certificate) bool {
+	name, ok := c.serviceOf(leaf)
+	return ok && name == c.service
+}
+
+// authorize checks intention allowing client with leaf certificate to call the service.
+func (c *Connect) authorize(leaf *x509.Certificate) error {
+	if c.IsSelf(leaf) {
+		return nil
+	}
+
+	uri := uriOf(leaf)
+	auth, err := c.agent.ConnectAuthorize(&api.AgentAuthorizeParams{
+		Target:           c.service,
+		ClientCertURI:    uri,
+		ClientCertSerial: hexString(leaf.SerialNumber.Bytes()),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to authorize %s", uri)
+	}
+	if !auth.Authorized {
+		return errors.Errorf("%s isn't authorized to call %s: %s", uri, c.service, auth.Reason)
+	}
+	return nil
+}
+
+// serviceOf returns service name of SPIFFE ID spiffe://<trust domain>/ns/<namespace>/dc/<dc>/svc/<service>
+// of certificate issued by connect CA of the trust domain.
+func (c *Connect) serviceOf(cert *x509.Certificate) (string, bool) {
+	if len(cert.URIs) == 0 {
+		return "", false
+	}
+	uri := cert.URIs[0]
+
+	c.lock.RLock()
+	trustDomain := c.trustDomain
+	c.lock.RUnlock()
+	if uri.Scheme != "spiffe" || !strings.EqualFold(uri.Host, trustDomain) {
+		return "", false
+	}
+
+	i := strings.LastIndex(uri.Path, "/svc/")
+	if i < 0 {
+		return "", false
+	}
+	return uri.Path[i+len("/svc/"):], true
+}
+
+func uriOf(cert *x509.Certificate) string {
+	if len(cert.URIs) == 0 {
+		return ""
+	}
+	return cert.URIs[0].String()
+}
+
+// hexString formats serial number as consul does, e.g. 0a:1b:2c.
+func hexString(b []byte) string {
+	parts := make([]string, 0, len(b))
+	for _, c := range b {
+		parts = append(parts, fmt.Sprintf("%02x", c))
+	}
+	return strings.Join(parts, ":")
+}
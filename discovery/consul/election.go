@@ -0,0 +1,181 @@
+package consul
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/grpclog"
+)
+
+// ElectionConfig configures leader election on consul session and KV lock.
+type ElectionConfig struct {
+	// Key is consul KV key of the lock, service/<service name>/leader by default.
+	Key string
+	// SessionTTL is TTL of consul session holding the lock, the session is renewed every half of TTL.
+	// Leadership is lost if session isn't renewed within TTL, e.g. consul agent is unreachable.
+	SessionTTL time.Duration
+	// RetryInterval is delay of the next campaign after consul error.
+	RetryInterval time.Duration
+}
+
+func (c *ElectionConfig) withDefaults(name string) {
+	if c.Key == "" {
+		c.Key = "service/" + name + "/leader"
+	}
+	if c.SessionTTL == 0 {
+		c.SessionTTL = 15 * time.Second
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = 5 * time.Second
+	}
+}
+
+// ElectionCallbacks are called on change of leadership, they are called sequentially.
+type ElectionCallbacks struct {
+	// OnElected is called once the lock is acquired, ctx is canceled when leadership is lost.
+	// It must not block, work of the leader is run in goroutines stopped by ctx.
+	OnElected func(ctx context.Context)
+	// OnLost is called once leadership is lost or released.
+	OnLost func()
+}
+
+// Election campaigns for leadership among instances of service, the leader is holder of consul KV lock.
+type Election struct {
+	cfg       ElectionConfig
+	client    *api.Client
+	callbacks ElectionCallbacks
+
+	// done is closed once Run returns
+	done chan struct{}
+
+	lock   sync.Mutex
+	leader bool
+	err    error
+}
+
+// NewElection creates election of instances of service registered with cfg, Run starts campaign.
+func NewElection(cfg Config, electionCfg ElectionConfig, callbacks ElectionCallbacks) (*Election, error) {
+	electionCfg.withDefaults(cfg.Name)
+
+	consulConfig := api.DefaultConfig()
+	consulConfig.Address = cfg.Endpoint
+	client, err := api.NewClient(consulConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error create consul client")
+	}
+
+	return &Election{cfg: electionCfg, client: client, callbacks: callbacks, done: make(chan struct{})}, nil
+}
+
+// Key returns consul KV key of the lock.
+func (e *Election) Key() string {
+	return e.cfg.Key
+}
+
+// IsLeader checks if the instance holds the lock.
+func (e *Election) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.leader
+}
+
+// Check fails if the last campaign failed because of consul error, followers pass it.
+func (e *Election) Check(_ context.Context) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.err
+}
+
+// Wait waits until Run returns, so the lock is released once its ctx is done. It blocks until Run is called.
+func (e *Election) Wait() {
+	<-e.done
+}
+
+// Run campaigns for leadership until ctx is done, then releases the lock and destroys the session.
+// It must be called once.
+func (e *Election) Run(ctx context.Context) {
+	defer close(e.done)
+
+	for ctx.Err() == nil {
+		err := e.campaign(ctx)
+		e.setErr(err)
+		if err == nil {
+			continue
+		}
+
+		grpclog.Errorf("leader election of %s failed, retrying in %s: %v", e.cfg.Key, e.cfg.RetryInterval, err)
+		select {
+		case <-time.After(e.cfg.RetryInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// campaign waits for the lock and holds it until leadership is lost or ctx is done.
+func (e *Election) campaign(ctx context.Context) error {
+	lock, err := e.client.LockOpts(&api.LockOptions{
+		Key:         e.cfg.Key,
+		SessionName: e.cfg.Key,
+		SessionTTL:  e.cfg.SessionTTL.String(),
+		// tolerate short consul unavailability while the session is still valid
+		MonitorRetries: 3,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create lock")
+	}
+
+	lostCh, err := lock.Lock(ctx.Done())
+	if err != nil {
+		return errors.Wrap(err, "failed to acquire lock")
+	}
+	if lostCh == nil {
+		// ctx is done
+		return nil
+	}
+	// acquired lock means consul is reachable
+	e.setErr(nil)
+
+	grpclog.Infof("elected leader of %s", e.cfg.Key)
+	leaderCtx, cancel := context.WithCancel(ctx)
+	e.setLeader(true)
+	if e.callbacks.OnElected != nil {
+		e.callbacks.OnElected(leaderCtx)
+	}
+
+	select {
+	case <-lostCh:
+		grpclog.Warningf("lost leadership of %s", e.cfg.Key)
+	case <-ctx.Done():
+		grpclog.Infof("releasing leadership of %s", e.cfg.Key)
+	}
+	cancel()
+	e.setLeader(false)
+	if e.callbacks.OnLost != nil {
+		e.callbacks.OnLost()
+	}
+
+	// Unlock stops renewal of the session, which destroys it, so the lock is free for other instances right away
+	if err := lock.Unlock(); err != nil && err != api.ErrLockNotHeld {
+		grpclog.Errorf("failed to release lock %s: %v", e.cfg.Key, err)
+	}
+	return nil
+}
+
+func (e *Election) setLeader(leader bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.leader = leader
+}
+
+func (e *Election) setErr(err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.err = err
+}
@@ -0,0 +1,304 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeConsul serves sessions and KV endpoints used by consul lock, blocking queries wait for the next change.
+type fakeConsul struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	sessions map[string]bool
+	pairs    map[string]*api.KVPair
+	created  int
+	stopped  chan struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	c := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		sessions: map[string]bool{},
+		pairs:    map[string]*api.KVPair{},
+		stopped:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/session/create", c.createSession)
+	mux.HandleFunc("/v1/session/renew/", c.renewSession)
+	mux.HandleFunc("/v1/session/destroy/", c.destroySession)
+	mux.HandleFunc("/v1/kv/", c.kv)
+	c.Server = httptest.NewServer(mux)
+	return c
+}
+
+// stop unblocks blocking queries and closes the server.
+func (c *fakeConsul) stop() {
+	close(c.stopped)
+	c.Close()
+}
+
+// changeLocked bumps index and wakes blocking queries.
+func (c *fakeConsul) changeLocked() {
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) createSession(w http.ResponseWriter, _ *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.created++
+	id := fmt.Sprintf("session-%d", c.created)
+	c.sessions[id] = true
+	json.NewEncoder(w).Encode(map[string]string{"ID": id})
+}
+
+func (c *fakeConsul) renewSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.sessions[id] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode([]*api.SessionEntry{{ID: id, TTL: "10s"}})
+}
+
+func (c *fakeConsul) destroySession(w http.ResponseWriter, r *http.Request) {
+	c.invalidate(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+	w.Write([]byte("true"))
+}
+
+// invalidate destroys session and releases locks it holds, as consul does once session TTL expires.
+func (c *fakeConsul) invalidate(session string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.sessions, session)
+	for _, pair := range c.pairs {
+		if pair.Session == session {
+			pair.Session = ""
+		}
+	}
+	c.changeLocked()
+}
+
+// holder returns session holding lock of key.
+func (c *fakeConsul) holder(key string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if pair, ok := c.pairs[key]; ok {
+		return pair.Session
+	}
+	return ""
+}
+
+func (c *fakeConsul) kv(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		c.get(w, r, key)
+	case http.MethodPut:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		ok := false
+		pair := c.pairs[key]
+		if session := query.Get("acquire"); session != "" {
+			if c.sessions[session] && (pair == nil || pair.Session == "" || pair.Session == session) {
+				flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+				c.pairs[key] = &api.KVPair{Key: key, Flags: flags, Session: session}
+				ok = true
+			}
+		} else if session := query.Get("release"); session != "" {
+			if pair != nil && pair.Session == session {
+				pair.Session = ""
+				ok = true
+			}
+		}
+		if ok {
+			c.changeLocked()
+		}
+		w.Write([]byte(strconv.FormatBool(ok)))
+	}
+}
+
+func (c *fakeConsul) get(w http.ResponseWriter, r *http.Request, key string) {
+	c.lock.Lock()
+	index, changed := c.index, c.changed
+	c.lock.Unlock()
+
+	if wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); wait >= index {
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+			return
+		case <-c.stopped:
+			return
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	pair, ok := c.pairs[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode([]*api.KVPair{pair})
+}
+
+// electionEvents records callbacks of election.
+type electionEvents struct {
+	elected chan context.Context
+	lost    chan struct{}
+}
+
+func newTestElection(t *testing.T, c *fakeConsul) (*Election, electionEvents) {
+	events := electionEvents{elected: make(chan context.Context, 10), lost: make(chan struct{}, 10)}
+	e, err := NewElection(Config{Name: "svc", Endpoint: strings.TrimPrefix(c.URL, "http://")},
+		ElectionConfig{SessionTTL: 10 * time.Second, RetryInterval: 10 * time.Millisecond},
+		ElectionCallbacks{
+			OnElected: func(ctx context.Context) { events.elected <- ctx },
+			OnLost:    func() { events.lost <- struct{}{} },
+		})
+	if err != nil {
+		t.Fatalf("NewElection: %v", err)
+	}
+	return e, events
+}
+
+func waitElected(t *testing.T, events electionEvents) context.Context {
+	select {
+	case ctx := <-events.elected:
+		return ctx
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnElected wasn't called")
+		return nil
+	}
+}
+
+func waitLost(t *testing.T, events electionEvents) {
+	select {
+	case <-events.lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnLost wasn't called")
+	}
+}
+
+func TestElectionAcquire(t *testing.T) {
+	c := newFakeConsul()
+	defer c.stop()
+	e, events := newTestElection(t, c)
+	if want := "service/svc/leader"; e.Key() != want {
+		t.Errorf("Key() = %s, want %s", e.Key(), want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go e.Run(ctx)
+	defer func() {
+		cancel()
+		e.Wait()
+	}()
+
+	leaderCtx := waitElected(t, events)
+	if !e.IsLeader() {
+		t.Error("IsLeader() = false after OnElected")
+	}
+	if c.holder(e.Key()) == "" {
+		t.Error("lock isn't held in consul after OnElected")
+	}
+	if err := e.Check(ctx); err != nil {
+		t.Errorf("Check() = %v, want nil", err)
+	}
+	if leaderCtx.Err() != nil {
+		t.Error("leader ctx is done while leadership is held")
+	}
+}
+
+func TestElectionSessionLost(t *testing.T) {
+	c := newFakeConsul()
+	defer c.stop()
+	e, events := newTestElection(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go e.Run(ctx)
+	defer func() {
+		cancel()
+		e.Wait()
+	}()
+
+	leaderCtx := waitElected(t, events)
+	first := c.holder(e.Key())
+	c.invalidate(first)
+
+	waitLost(t, events)
+	if leaderCtx.Err() == nil {
+		t.Error("leader ctx isn't done after leadership is lost")
+	}
+
+	// the next campaign acquires the lock with a new session
+	waitElected(t, events)
+	if holder := c.holder(e.Key()); holder == "" || holder == first {
+		t.Errorf("lock is held by %q after new campaign, want new session other than %q", holder, first)
+	}
+	if !e.IsLeader() {
+		t.Error("IsLeader() = false after re-election")
+	}
+}
+
+func TestElectionReleaseOnCancel(t *testing.T) {
+	c := newFakeConsul()
+	defer c.stop()
+	e, events := newTestElection(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go e.Run(ctx)
+	waitElected(t, events)
+
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		e.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return after ctx is done")
+	}
+
+	// Wait returns once callbacks are called and the lock is released
+	select {
+	case <-events.lost:
+	default:
+		t.Error("OnLost wasn't called before Wait returned")
+	}
+	if e.IsLeader() {
+		t.Error("IsLeader() = true after release")
+	}
+	if holder := c.holder(e.Key()); holder != "" {
+		t.Errorf("lock is held by %q after release", holder)
+	}
+}
@@ -1,12 +1,18 @@
 package consul
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/humans-net/grpc-core/discovery"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
 )
 
 type Service struct {
@@ -16,57 +22,174 @@ type Service struct {
 	Name string
 }
 
-// populate with ld flags
-var (
-	env     string
-	ip      string
-	port    string
-	portInt int
-)
+// Registry registers instances to consul agent with health checks of Config.
+// Instances are watched by the same blocking queries as resolvers of ResolverBuilder use.
+type Registry struct {
+	cfg     Config
+	agent   *api.Agent
+	builder *consulBuilder
 
-func init() {
-	var err error
-	portInt, err = strconv.Atoi(port)
-	if err != nil {
-		panic(fmt.Sprintf("failed to convert port %s string to int: %v", port, err))
-	}
+	lock         sync.Mutex
+	registration *Registration
 }
 
-func RegisterService(cfg Config) {
-	grpclog.Infof("consul envs %s %s %s", env, ip, port)
-
+// NewRegistry creates registry of consul agent at cfg.Endpoint.
+func NewRegistry(cfg Config, opts ...BuilderOption) (*Registry, error) {
 	consulConfig := api.DefaultConfig()
 	consulConfig.Address = cfg.Endpoint
 	client, err := api.NewClient(consulConfig)
 	if err != nil {
-		grpclog.Fatalf("NewClient error: %v", err)
-		return
+		return nil, errors.Wrap(err, "error create consul client")
 	}
-	agent := client.Agent()
-	interval := 10 * time.Second
-	deregister := time.Minute
 
-	reg := &api.AgentServiceRegistration{
-		ID:      fmt.Sprintf("%v-%v-%v", cfg.Name, ip, port),
-		Name:    cfg.Name,
-		Tags:    []string{env},
-		Port:    portInt,
-		Address: ip,
-		Check: &api.AgentServiceCheck{
-			// health check interval
-			Interval: interval.String(),
-			// grpc support, address to perform health check, service will be passed to HealthCheck function
-			GRPC: fmt.Sprintf("%v:%v/%v", ip, port, cfg.Name),
-			// logout time, equivalent to expiration time
-			DeregisterCriticalServiceAfter: deregister.String(),
-		},
+	builder := NewBuilder(opts...).(*consulBuilder)
+	builder.clients[cfg.Endpoint] = client
+	return &Registry{cfg: cfg, agent: client.Agent(), builder: builder}, nil
+}
+
+// ResolverBuilder returns builder of consul resolvers sharing watchers with the registry.
+func (r *Registry) ResolverBuilder() resolver.Builder {
+	return r.builder
+}
+
+// Register registers instance with health checks, grpc check by default and http check for connect native service.
+func (r *Registry) Register(_ context.Context, instance discovery.Instance) error {
+	host, portStr, err := net.SplitHostPort(instance.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid address of instance %s", instance.ID)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid port of instance %s", instance.ID)
 	}
 
+	checkCfgs := r.cfg.Checks
+	if len(checkCfgs) == 0 {
+		checkCfgs = []CheckConfig{{Type: CheckGRPC}}
+		if r.cfg.Connect {
+			checkCfgs = []CheckConfig{{Type: CheckHTTP}}
+		}
+	}
+
+	registration := &Registration{agent: r.agent}
+	var checks api.AgentServiceChecks
+	for i, checkCfg := range checkCfgs {
+		checkCfg.withDefaults()
+		check, err := checkCfg.agentCheck(instance.Name, fmt.Sprintf("%s:%s:%d", instance.ID, checkCfg.Type, i), instance.Addr)
+		if err != nil {
+			return err
+		}
+		if checkCfg.Type == CheckTTL {
+			registration.ttlChecks = append(registration.ttlChecks, check.CheckID)
+			if registration.ttl == 0 || checkCfg.TTL < registration.ttl {
+				registration.ttl = checkCfg.TTL
+			}
+		}
+		checks = append(checks, check)
+	}
+
+	reg := &api.AgentServiceRegistration{
+		ID:      instance.ID,
+		Name:    instance.Name,
+		Tags:    instance.Tags,
+		Meta:    instance.Meta,
+		Port:    port,
+		Address: host,
+		Checks:  checks,
+	}
+	if r.cfg.Connect {
+		reg.Connect = &api.AgentServiceConnect{Native: true}
+	}
 	grpclog.Infof("reg request %+v", reg)
+	grpclog.Infof("registering to %v", r.cfg.Endpoint)
+	if err := r.agent.ServiceRegister(reg); err != nil {
+		return errors.Wrap(err, "service register error")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.registration = registration
+
+	return nil
+}
+
+// Registration returns the last registered instance, nil if there is none.
+func (r *Registry) Registration() *Registration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-	grpclog.Infof("registering to %v", cfg.Endpoint)
-	if err := agent.ServiceRegister(reg); err != nil {
+	return r.registration
+}
+
+// Deregister removes instance with its checks from consul agent.
+func (r *Registry) Deregister(_ context.Context, instance discovery.Instance) error {
+	if err := r.agent.ServiceDeregister(instance.ID); err != nil {
+		return errors.Wrapf(err, "failed to deregister %s", instance.ID)
+	}
+	return nil
+}
+
+// Watch calls onUpdate with healthy instances of service known by consul agent of the registry.
+func (r *Registry) Watch(ctx context.Context, service string, onUpdate func([]discovery.Instance)) error {
+	sub := &watchSubscriber{onUpdate: onUpdate}
+	w, err := r.builder.subscribe(watcherKey{address: r.cfg.Endpoint, service: service}, sub)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		r.builder.unsubscribe(w, sub)
+	}()
+	return nil
+}
+
+// watchSubscriber passes instances of watched service to Watch callback.
+type watchSubscriber struct {
+	onUpdate func([]discovery.Instance)
+}
+
+func (s *watchSubscriber) update(instances []discovery.Instance, _ resolver.State) {
+	s.onUpdate(instances)
+}
+
+// RegisterService registers the running service described by ld flags, see Registry.Register.
+func RegisterService(cfg Config) *Registration {
+	instance := discovery.LocalInstance(cfg.Name, cfg.Meta)
+	grpclog.Infof("consul envs %s %s", instance.Tags, instance.Addr)
+
+	r, err := NewRegistry(cfg)
+	if err != nil {
+		grpclog.Fatalf("NewClient error: %v", err)
+		return nil
+	}
+	if err := r.Register(context.Background(), instance); err != nil {
 		grpclog.Fatalf("Service Register error: %v", err)
-		return
+		return nil
+	}
+
+	return r.Registration()
+}
+
+// Registration is service instance registered in consul.
+type Registration struct {
+	agent *api.Agent
+	// ttlChecks are IDs of TTL checks, which status is reported by UpdateTTL
+	ttlChecks []string
+	ttl       time.Duration
+}
+
+// TTL returns the shortest TTL of TTL checks, zero if there are none.
+func (r *Registration) TTL() time.Duration {
+	return r.ttl
+}
+
+// UpdateTTL reports status of all TTL checks, status is one of api.HealthPassing, api.HealthWarning and api.HealthCritical.
+func (r *Registration) UpdateTTL(status, output string) error {
+	for _, checkID := range r.ttlChecks {
+		if err := r.agent.UpdateTTL(checkID, output, status); err != nil {
+			return errors.Wrapf(err, "failed to update TTL check %s", checkID)
+		}
 	}
+	return nil
 }
@@ -1,88 +1,156 @@
 package consul
 
 import (
-	"fmt"
+	"net/url"
 	"sync"
 
 	"github.com/hashicorp/consul/api"
-	"google.golang.org/grpc/grpclog"
+	"github.com/humans-net/grpc-core/discovery"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc/resolver"
 )
 
-func RegisterResolver() {
-	resolver.Register(NewBuilder())
+const (
+	// Scheme of consul resolver.
+	Scheme = "consul"
+	// ServiceConfigMetaKey is service meta key of grpc service config json, which overrides client configuration.
+	ServiceConfigMetaKey = "grpc_service_config"
+	// ServiceConfigKVPrefix is prefix of consul KV key <prefix><service name> of grpc service config json.
+	// Service meta takes precedence over KV.
+	ServiceConfigKVPrefix = "grpc/service-config/"
+)
+
+// BuilderOption configures consul resolver builder.
+type BuilderOption func(b *consulBuilder)
+
+// WithCacheDir persists last known instances of services to dir, so clients can start with them while consul is down.
+func WithCacheDir(dir string) BuilderOption {
+	return func(b *consulBuilder) {
+		b.cache = &diskCache{dir: dir}
+	}
 }
 
+// RegisterResolver registers consul resolver, target is consul://<agent address>/<service>[?tag=<tag>].
+func RegisterResolver(opts ...BuilderOption) {
+	resolver.Register(NewBuilder(opts...))
+}
+
+// consulBuilder shares watchers between resolvers of the same service, agent and tag.
 type consulBuilder struct {
+	cache *diskCache
+
+	lock     sync.Mutex
+	clients  map[string]*api.Client
+	watchers map[watcherKey]*serviceWatcher
 }
 
 type consulResolver struct {
-	address              string
-	wg                   sync.WaitGroup
+	builder              *consulBuilder
+	watcher              *serviceWatcher
 	cc                   resolver.ClientConn
-	name                 string
 	disableServiceConfig bool
-	lastIndex            uint64
+	closeOnce            sync.Once
 }
 
-func NewBuilder() resolver.Builder {
-	return &consulBuilder{}
+func NewBuilder(opts ...BuilderOption) resolver.Builder {
+	b := &consulBuilder{
+		clients:  map[string]*api.Client{},
+		watchers: map[watcherKey]*serviceWatcher{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
 func (cb *consulBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	key, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
 	cr := &consulResolver{
-		address:              target.Authority,
-		name:                 target.Endpoint,
+		builder:              cb,
 		cc:                   cc,
 		disableServiceConfig: opts.DisableServiceConfig,
-		lastIndex:            0,
+	}
+	cr.watcher, err = cb.subscribe(key, cr)
+	if err != nil {
+		return nil, err
 	}
 
-	cr.wg.Add(1)
-	go cr.watcher()
 	return cr, nil
 }
 
-func (cr *consulResolver) watcher() {
-	config := api.DefaultConfig()
-	config.Address = cr.address
-	client, err := api.NewClient(config)
-	if err != nil {
-		grpclog.Errorf("error create consul client: %v", err)
-		return
+// parseTarget parses consul://<agent address>/<service>[?tag=<tag>].
+func parseTarget(target resolver.Target) (watcherKey, error) {
+	u, err := url.Parse(target.Endpoint)
+	if err != nil || u.Path == "" {
+		return watcherKey{}, errors.Errorf("invalid consul target service %q", target.Endpoint)
 	}
 
-	for {
-		services, metainfo, err := client.Health().Service(cr.name, "", true,
-			&api.QueryOptions{WaitIndex: cr.lastIndex})
-		if err != nil {
-			grpclog.Errorf("error retrieving instances from Consul: %v", err)
-			continue
-		}
+	return watcherKey{
+		address: target.Authority,
+		service: u.Path,
+		tag:     u.Query().Get("tag"),
+	}, nil
+}
 
-		cr.lastIndex = metainfo.LastIndex
-		var newAddrs []resolver.Address
-		for _, service := range services {
-			addr := fmt.Sprintf("%v:%v", service.Service.Address, service.Service.Port)
-			newAddrs = append(newAddrs, resolver.Address{Addr: addr})
+// subscribe adds sub to watcher of key, starting watcher if there is none.
+func (cb *consulBuilder) subscribe(key watcherKey, sub subscriber) (*serviceWatcher, error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	w, ok := cb.watchers[key]
+	if !ok {
+		client, ok := cb.clients[key.address]
+		if !ok {
+			config := api.DefaultConfig()
+			config.Address = key.address
+			var err error
+			client, err = api.NewClient(config)
+			if err != nil {
+				return nil, errors.Wrap(err, "error create consul client")
+			}
+			cb.clients[key.address] = client
 		}
 
-		grpclog.Infof("consul resolver got new addresses %+v", newAddrs)
-
-		cr.cc.UpdateState(resolver.State{
-			Addresses: newAddrs,
-		})
-		//cr.cc.NewServiceConfig(cr.name)
+		w = newServiceWatcher(key, client, cb.cache)
+		cb.watchers[key] = w
 	}
+	w.subscribe(sub)
+
+	return w, nil
+}
+
+// unsubscribe removes sub from watcher, watcher is stopped once it has no subscribers left.
+func (cb *consulBuilder) unsubscribe(w *serviceWatcher, sub subscriber) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
 
+	if w.unsubscribe(sub) == 0 {
+		delete(cb.watchers, w.key)
+		w.stop()
+	}
 }
 
 func (cb *consulBuilder) Scheme() string {
-	return "consul"
+	return Scheme
+}
+
+// update passes state of watcher to grpc.
+func (cr *consulResolver) update(_ []discovery.Instance, state resolver.State) {
+	if cr.disableServiceConfig {
+		state.ServiceConfig = nil
+	}
+	cr.cc.UpdateState(state)
 }
 
 func (cr *consulResolver) ResolveNow(opt resolver.ResolveNowOption) {
 }
 
 func (cr *consulResolver) Close() {
+	cr.closeOnce.Do(func() {
+		cr.builder.unsubscribe(cr.watcher, cr)
+	})
 }
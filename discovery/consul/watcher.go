@@ -0,0 +1,273 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/humans-net/grpc-core/discovery"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const (
+	minRetryBackoff = time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+// watcherKey identifies blocking query shared by resolvers.
+type watcherKey struct {
+	address string
+	service string
+	tag     string
+}
+
+func (k watcherKey) String() string {
+	if k.tag == "" {
+		return k.service
+	}
+	return k.service + "?tag=" + k.tag
+}
+
+// subscriber gets instances of watched service and resolver state built from them.
+type subscriber interface {
+	update(instances []discovery.Instance, state resolver.State)
+}
+
+// serviceWatcher runs blocking queries of healthy instances of service and of its service config in KV,
+// and passes them to subscribers. The last known instances are kept in memory and in disk cache,
+// so resolvers get them while consul is unreachable.
+type serviceWatcher struct {
+	key    watcherKey
+	client *api.Client
+	cache  *diskCache
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock        sync.Mutex
+	subscribers map[subscriber]struct{}
+	// instances and state are the last known ones, they are valid if hasState is set
+	instances []discovery.Instance
+	state     resolver.State
+	hasState  bool
+	// metaServiceConfig is service config json in meta of instances, it takes precedence over kvServiceConfig
+	metaServiceConfig string
+	kvServiceConfig   string
+	// rawServiceConfig is the last valid service config json, serviceConfig is parsed from it
+	rawServiceConfig string
+	serviceConfig    serviceconfig.Config
+}
+
+func newServiceWatcher(key watcherKey, client *api.Client, cache *diskCache) *serviceWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &serviceWatcher{
+		key:         key,
+		client:      client,
+		cache:       cache,
+		ctx:         ctx,
+		cancel:      cancel,
+		subscribers: map[subscriber]struct{}{},
+	}
+	go w.watch()
+	go w.watchServiceConfig()
+
+	return w
+}
+
+// subscribe adds subscriber, which gets the last known state right away.
+func (w *serviceWatcher) subscribe(sub subscriber) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.subscribers[sub] = struct{}{}
+	if w.hasState {
+		sub.update(w.instances, w.state)
+	}
+}
+
+// unsubscribe removes subscriber and returns number of subscribers left.
+func (w *serviceWatcher) unsubscribe(sub subscriber) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	delete(w.subscribers, sub)
+	return len(w.subscribers)
+}
+
+func (w *serviceWatcher) stop() {
+	w.cancel()
+}
+
+// retry waits for backoff and returns the next one, or false if watcher is stopped.
+func (w *serviceWatcher) retry(backoff time.Duration) (time.Duration, bool) {
+	select {
+	case <-time.After(backoff):
+	case <-w.ctx.Done():
+		return backoff, false
+	}
+	if backoff *= 2; backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff, true
+}
+
+func (w *serviceWatcher) watch() {
+	var lastIndex uint64
+	backoff := minRetryBackoff
+	for {
+		opts := (&api.QueryOptions{WaitIndex: lastIndex}).WithContext(w.ctx)
+		services, metainfo, err := w.client.Health().Service(w.key.service, w.key.tag, true, opts)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			grpclog.Errorf("error retrieving instances of %s from Consul, retrying in %s: %v", w.key, backoff, err)
+			w.restoreCache()
+			var ok bool
+			if backoff, ok = w.retry(backoff); !ok {
+				return
+			}
+			continue
+		}
+		backoff = minRetryBackoff
+
+		// index going backwards means consul state was reset
+		if metainfo.LastIndex < lastIndex {
+			lastIndex = 0
+			continue
+		}
+		lastIndex = metainfo.LastIndex
+
+		instances := make([]discovery.Instance, 0, len(services))
+		metaServiceConfig := ""
+		for _, service := range services {
+			instances = append(instances, discovery.Instance{
+				ID:   service.Service.ID,
+				Name: service.Service.Service,
+				Addr: fmt.Sprintf("%v:%v", service.Service.Address, service.Service.Port),
+				Meta: service.Service.Meta,
+				Tags: service.Service.Tags,
+			})
+			if sc := service.Service.Meta[ServiceConfigMetaKey]; sc != "" && metaServiceConfig == "" {
+				metaServiceConfig = sc
+			}
+		}
+
+		grpclog.Infof("consul resolver got %d instances of %s", len(instances), w.key)
+		w.store(w.update(instances, metaServiceConfig))
+	}
+}
+
+// watchServiceConfig runs blocking query of service config stored in KV.
+func (w *serviceWatcher) watchServiceConfig() {
+	var lastIndex uint64
+	backoff := minRetryBackoff
+	for {
+		opts := (&api.QueryOptions{WaitIndex: lastIndex}).WithContext(w.ctx)
+		pair, metainfo, err := w.client.KV().Get(ServiceConfigKVPrefix+w.key.service, opts)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			grpclog.Errorf("error retrieving service config of %s from Consul, retrying in %s: %v", w.key.service, backoff, err)
+			var ok bool
+			if backoff, ok = w.retry(backoff); !ok {
+				return
+			}
+			continue
+		}
+		backoff = minRetryBackoff
+
+		if metainfo.LastIndex < lastIndex {
+			lastIndex = 0
+			continue
+		}
+		lastIndex = metainfo.LastIndex
+
+		raw := ""
+		if pair != nil {
+			raw = string(pair.Value)
+		}
+		w.store(w.updateServiceConfig(raw))
+	}
+}
+
+// restoreCache passes instances stored on disk to resolvers, unless there is state already.
+func (w *serviceWatcher) restoreCache() {
+	w.lock.Lock()
+	hasState := w.hasState
+	w.lock.Unlock()
+	if hasState {
+		return
+	}
+
+	cached, ok := w.cache.load(w.key)
+	if !ok {
+		return
+	}
+	grpclog.Warningf("consul resolver uses %d cached instances of %s", len(cached.Instances), w.key)
+	w.update(cached.Instances, cached.ServiceConfig)
+}
+
+// store caches state on disk, unless it has no instances, which would only hide ones cached earlier.
+func (w *serviceWatcher) store(state cachedState) {
+	if len(state.Instances) == 0 {
+		return
+	}
+	w.cache.store(w.key, state)
+}
+
+// update passes instances to subscribers and returns state to be cached.
+func (w *serviceWatcher) update(instances []discovery.Instance, metaServiceConfig string) cachedState {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.instances, w.metaServiceConfig = instances, metaServiceConfig
+	w.hasState = true
+	return w.publishLocked()
+}
+
+// updateServiceConfig passes service config from KV to subscribers once instances are known.
+func (w *serviceWatcher) updateServiceConfig(raw string) cachedState {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.kvServiceConfig = raw
+	if !w.hasState {
+		return cachedState{}
+	}
+	return w.publishLocked()
+}
+
+func (w *serviceWatcher) publishLocked() cachedState {
+	raw := w.metaServiceConfig
+	if raw == "" {
+		raw = w.kvServiceConfig
+	}
+	w.state = resolver.State{Addresses: discovery.Addresses(w.instances), ServiceConfig: w.parseServiceConfigLocked(raw)}
+	for sub := range w.subscribers {
+		sub.update(w.instances, w.state)
+	}
+	return cachedState{Instances: w.instances, ServiceConfig: w.rawServiceConfig}
+}
+
+// parseServiceConfigLocked parses raw service config, invalid or missing one is ignored and the last valid one is kept.
+func (w *serviceWatcher) parseServiceConfigLocked(raw string) serviceconfig.Config {
+	if raw == "" || raw == w.rawServiceConfig {
+		return w.serviceConfig
+	}
+
+	sc, err := serviceconfig.Parse(raw)
+	if err != nil {
+		grpclog.Errorf("invalid service config of %s in Consul: %v", w.key.service, err)
+		return w.serviceConfig
+	}
+	grpclog.Infof("consul resolver got new service config of %s %s", w.key.service, raw)
+	w.rawServiceConfig, w.serviceConfig = raw, sc
+
+	return sc
+}
@@ -0,0 +1,154 @@
+// Package dir implements registry keeping instances as JSON files in directory shared by services,
+// e.g. to run services on a single machine without consul. Instance is stored in <dir>/<service>/<instance id>.json,
+// file of instance stopped without deregistration stays there until it is removed by hand.
+// Target of resolver is dir:///<service name>.
+package dir
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/humans-net/grpc-core/discovery"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme of dir resolver.
+const Scheme = "dir"
+
+// Registry keeps instances of services in dir.
+type Registry struct {
+	dir string
+}
+
+// NewRegistry creates registry of instances in dir.
+func NewRegistry(dir string) *Registry {
+	return &Registry{dir: filepath.Clean(dir)}
+}
+
+// ResolverBuilder returns builder of resolvers of instances in the registry.
+func (r *Registry) ResolverBuilder() resolver.Builder {
+	return discovery.NewResolverBuilder(Scheme, r)
+}
+
+func (r *Registry) serviceDir(service string) string {
+	return filepath.Join(r.dir, service)
+}
+
+func (r *Registry) path(instance discovery.Instance) string {
+	return filepath.Join(r.serviceDir(instance.Name), instance.ID+".json")
+}
+
+// Register writes instance file atomically, so watchers never read partially written one.
+func (r *Registry) Register(_ context.Context, instance discovery.Instance) error {
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal instance %s", instance.ID)
+	}
+	dir := r.serviceDir(instance.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create registry dir %s", dir)
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to register instance %s", instance.ID)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.path(instance))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to register instance %s", instance.ID)
+	}
+	return nil
+}
+
+// Deregister removes instance file.
+func (r *Registry) Deregister(_ context.Context, instance discovery.Instance) error {
+	if err := os.Remove(r.path(instance)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to deregister instance %s", instance.ID)
+	}
+	return nil
+}
+
+// Watch reads instances of service on every change of its directory.
+func (r *Registry) Watch(ctx context.Context, service string, onUpdate func([]discovery.Instance)) error {
+	dir := r.serviceDir(service)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create registry dir %s", dir)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "failed to create registry watcher")
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return errors.Wrapf(err, "failed to watch registry dir %s", dir)
+	}
+
+	onUpdate(load(dir))
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !strings.HasSuffix(event.Name, ".json") {
+					continue
+				}
+				onUpdate(load(dir))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				grpclog.Errorf("registry watcher error: %v", err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// load reads instance files of dir, broken ones are skipped.
+func load(dir string) []discovery.Instance {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		grpclog.Errorf("failed to list instances in %s: %v", dir, err)
+		return nil
+	}
+	sort.Strings(paths)
+
+	instances := make([]discovery.Instance, 0, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				grpclog.Errorf("failed to read instance %s: %v", path, err)
+			}
+			continue
+		}
+		var instance discovery.Instance
+		if err := json.Unmarshal(data, &instance); err != nil {
+			grpclog.Errorf("failed to parse instance %s: %v", path, err)
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	return instances
+}
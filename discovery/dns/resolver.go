@@ -0,0 +1,168 @@
+// Package dns implements resolver looking up SRV records of target host, and its A/AAAA records if there are none,
+// e.g. dnssrv:///_grpc._tcp.users.service.local or dnssrv:///users.local:9000.
+// It has scheme of its own, so grpc dns resolver stays available as dns scheme.
+package dns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/humans-net/grpc-core/discovery"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// Scheme of dns resolver.
+	Scheme = "dnssrv"
+
+	defaultPort    = "443"
+	defaultRefresh = 30 * time.Second
+	lookupTimeout  = 10 * time.Second
+	// minResolveInterval limits re-resolution requested by grpc on connection failures
+	minResolveInterval = time.Second
+)
+
+// RegisterResolver registers dns resolver re-resolving targets every refresh interval, 30s by default.
+func RegisterResolver(refresh time.Duration) {
+	if refresh <= 0 {
+		refresh = defaultRefresh
+	}
+	resolver.Register(&builder{refresh: refresh})
+}
+
+type builder struct {
+	refresh time.Duration
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOption) (resolver.Resolver, error) {
+	host, port, err := net.SplitHostPort(target.Endpoint)
+	if err != nil {
+		// SRV records are looked up only for targets without port
+		host, port = target.Endpoint, ""
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &dnsResolver{
+		host:    host,
+		port:    port,
+		refresh: b.refresh,
+		cc:      cc,
+		ctx:     ctx,
+		cancel:  cancel,
+		now:     make(chan struct{}, 1),
+	}
+	r.wg.Add(1)
+	go r.watch()
+
+	return r, nil
+}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+type dnsResolver struct {
+	host, port string
+	refresh    time.Duration
+	cc         resolver.ClientConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	now    chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (r *dnsResolver) watch() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		resolved := time.Now()
+		addrs, err := r.lookup()
+		if err != nil {
+			grpclog.Errorf("dns resolver failed to resolve %s, keeping previous addresses: %v", r.host, err)
+		} else {
+			r.cc.UpdateState(resolver.State{Addresses: addrs})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.now:
+			select {
+			case <-time.After(minResolveInterval - time.Since(resolved)):
+			case <-r.ctx.Done():
+				return
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *dnsResolver) lookup() ([]resolver.Address, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, lookupTimeout)
+	defer cancel()
+
+	if r.port == "" {
+		if addrs := r.lookupSRV(ctx); len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+
+	port := r.port
+	if port == "" {
+		port = defaultPort
+	}
+	hosts, err := net.DefaultResolver.LookupHost(ctx, r.host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]resolver.Address, 0, len(hosts))
+	for _, host := range hosts {
+		addrs = append(addrs, resolver.Address{Addr: net.JoinHostPort(host, port)})
+	}
+	return addrs, nil
+}
+
+// lookupSRV returns targets of SRV records with the highest priority, SRV weights become instance weights.
+func (r *dnsResolver) lookupSRV(ctx context.Context) []resolver.Address {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", r.host)
+	if err != nil || len(srvs) == 0 {
+		return nil
+	}
+
+	var addrs []resolver.Address
+	// records are sorted by priority
+	priority := srvs[0].Priority
+	for _, srv := range srvs {
+		if srv.Priority != priority {
+			break
+		}
+		attrs := discovery.AttributesFromMeta(map[string]string{
+			discovery.MetaWeight: strconv.Itoa(int(srv.Weight)),
+		}, nil)
+		addrs = append(addrs, resolver.Address{
+			Addr:     net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))),
+			Metadata: attrs,
+		})
+	}
+	return addrs
+}
+
+func (r *dnsResolver) ResolveNow(resolver.ResolveNowOption) {
+	select {
+	case r.now <- struct{}{}:
+	default:
+	}
+}
+
+func (r *dnsResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
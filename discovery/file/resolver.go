@@ -0,0 +1,196 @@
+// Package file implements resolver of addresses listed in YAML or JSON file, which is watched for changes.
+// File maps service names to instances, given by address or by address with tags and meta:
+//
+//	users:
+//	  - localhost:9000
+//	  - addr: localhost:9001
+//	    tags: [canary]
+//	    meta: {zone: a, weight: "2"}
+//
+// Target is file:///<service name>.
+package file
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/humans-net/grpc-core/discovery"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+	"gopkg.in/yaml.v2"
+)
+
+// Scheme of file resolver.
+const Scheme = "file"
+
+// Instance is instance of service listed in file.
+type Instance struct {
+	Addr string            `yaml:"addr"`
+	Tags []string          `yaml:"tags"`
+	Meta map[string]string `yaml:"meta"`
+}
+
+// UnmarshalYAML allows instance to be given by address only.
+func (i *Instance) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&i.Addr); err == nil {
+		return nil
+	}
+
+	type instance Instance
+	return unmarshal((*instance)(i))
+}
+
+// RegisterResolver registers resolver of services listed in file at path.
+func RegisterResolver(path string) {
+	resolver.Register(&builder{
+		path:      filepath.Clean(path),
+		resolvers: map[*fileResolver]struct{}{},
+	})
+}
+
+type builder struct {
+	path string
+
+	lock sync.Mutex
+	// watcher watches file while there are resolvers, it is nil otherwise
+	watcher   *fsnotify.Watcher
+	services  map[string][]Instance
+	resolvers map[*fileResolver]struct{}
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOption) (resolver.Resolver, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.watcher == nil {
+		services, err := load(b.path)
+		if err != nil {
+			return nil, err
+		}
+		watcher, err := b.watch()
+		if err != nil {
+			return nil, err
+		}
+		b.services = services
+		b.watcher = watcher
+	}
+
+	r := &fileResolver{builder: b, name: target.Endpoint, cc: cc}
+	b.resolvers[r] = struct{}{}
+	r.update(b.services[r.name])
+
+	return r, nil
+}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+func load(path string) (map[string][]Instance, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read services file %s", path)
+	}
+
+	// JSON is valid YAML
+	services := map[string][]Instance{}
+	if err := yaml.Unmarshal(data, &services); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse services file %s", path)
+	}
+	return services, nil
+}
+
+// watch reloads file on change until watcher is closed.
+// Directory of the file is watched, as editors often replace file instead of writing it.
+func (b *builder) watch() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create services file watcher")
+	}
+	if err := watcher.Add(filepath.Dir(b.path)); err != nil {
+		watcher.Close()
+		return nil, errors.Wrapf(err, "failed to watch services file %s", b.path)
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != b.path || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				b.reload()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				grpclog.Errorf("services file watcher error: %v", err)
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+func (b *builder) reload() {
+	services, err := load(b.path)
+	if err != nil {
+		grpclog.Errorf("file resolver keeps previous addresses: %v", err)
+		return
+	}
+	grpclog.Infof("file resolver reloaded %s", b.path)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.services = services
+	for r := range b.resolvers {
+		r.update(services[r.name])
+	}
+}
+
+type fileResolver struct {
+	builder *builder
+	name    string
+	cc      resolver.ClientConn
+}
+
+func (r *fileResolver) update(instances []Instance) {
+	addrs := make([]resolver.Address, 0, len(instances))
+	for _, instance := range instances {
+		addrs = append(addrs, resolver.Address{
+			Addr:     instance.Addr,
+			Metadata: discovery.AttributesFromMeta(instance.Meta, instance.Tags),
+		})
+	}
+	if len(addrs) == 0 {
+		grpclog.Warningf("file resolver found no instances of %s", r.name)
+	}
+
+	r.cc.UpdateState(resolver.State{Addresses: addrs})
+}
+
+func (r *fileResolver) ResolveNow(resolver.ResolveNowOption) {}
+
+// Close stops watching of the file once the last resolver is closed.
+func (r *fileResolver) Close() {
+	b := r.builder
+	b.lock.Lock()
+	delete(b.resolvers, r)
+	var watcher *fsnotify.Watcher
+	if len(b.resolvers) == 0 {
+		watcher, b.watcher = b.watcher, nil
+	}
+	b.lock.Unlock()
+
+	// closed outside of the lock, as watcher goroutine may wait for it to reload the file
+	if watcher != nil {
+		watcher.Close()
+	}
+}
@@ -0,0 +1,85 @@
+// Package lb implements grpc load balancers driven by discovery.Attributes of resolved addresses.
+// All balancers of the package route calls to instances of Route set to call context.
+package lb
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// Balancer names to be used as grpc balancer name or in client configuration.
+const (
+	// WeightedRoundRobin spreads calls proportionally to instance weights.
+	WeightedRoundRobin = "weighted_round_robin"
+	// ZoneAware balances calls by weight between instances in local zone, and between all instances
+	// if there is no ready instance in local zone.
+	ZoneAware = "zone_aware"
+	// LeastRequest sends call to the less loaded of two random instances by number of outstanding calls.
+	LeastRequest = "least_request"
+)
+
+var registerOnce sync.Once
+
+// Register registers balancers of the package, zone is local zone preferred by ZoneAware balancer.
+// Only the first call takes effect.
+func Register(zone string) {
+	registerOnce.Do(func() {
+		register(WeightedRoundRobin, &wrrPickerBuilder{})
+		register(ZoneAware, &wrrPickerBuilder{zone: zone})
+		register(LeastRequest, &lrPickerBuilder{})
+	})
+}
+
+// register registers balancer name respecting route of calls.
+func register(name string, pb base.PickerBuilder) {
+	balancer.Register(&builder{name: name, pb: pb})
+}
+
+// builder builds base balancer per connection, detecting builders registered by WithOutlierDetection
+// add outlier detector of the connection.
+type builder struct {
+	name      string
+	pb        base.PickerBuilder
+	detecting bool
+}
+
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	var d *detector
+	if b.detecting {
+		if od := takeDetection(b.name); od != nil {
+			d = newDetector(od)
+		}
+	}
+	pb := &routingPickerBuilder{inner: b.pb, detector: d}
+	bal := base.NewBalancerBuilderWithConfig(b.name, pb, base.Config{HealthCheck: true}).Build(cc, opts)
+	if d == nil {
+		return bal
+	}
+
+	return &detectingBalancer{Balancer: bal, detector: d}
+}
+
+func (b *builder) Name() string {
+	return b.name
+}
+
+// detectingBalancer stops outlier detector when balancer is closed.
+type detectingBalancer struct {
+	balancer.Balancer
+	detector *detector
+}
+
+func (b *detectingBalancer) UpdateClientConnState(s balancer.ClientConnState) {
+	b.Balancer.(balancer.V2Balancer).UpdateClientConnState(s)
+}
+
+func (b *detectingBalancer) UpdateSubConnState(sc balancer.SubConn, s balancer.SubConnState) {
+	b.Balancer.(balancer.V2Balancer).UpdateSubConnState(sc, s)
+}
+
+func (b *detectingBalancer) Close() {
+	b.detector.close()
+	b.Balancer.Close()
+}
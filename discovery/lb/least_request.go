@@ -0,0 +1,56 @@
+package lb
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+type lrPickerBuilder struct{}
+
+func (*lrPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	items := make([]*lrItem, 0, len(readySCs))
+	for _, sc := range readySCs {
+		items = append(items, &lrItem{sc: sc})
+	}
+	return &lrPicker{items: items}
+}
+
+type lrItem struct {
+	sc          balancer.SubConn
+	outstanding int64
+}
+
+// lrPicker picks the one with less outstanding calls of two random instances.
+// Outstanding calls are counted per picker, so they start from zero whenever set of ready instances changes.
+type lrPicker struct {
+	items []*lrItem
+}
+
+func (p *lrPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	item := p.items[0]
+	if n := len(p.items); n > 1 {
+		i := rand.Intn(n)
+		j := rand.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+		item = p.items[i]
+		if other := p.items[j]; atomic.LoadInt64(&other.outstanding) < atomic.LoadInt64(&item.outstanding) {
+			item = other
+		}
+	}
+
+	atomic.AddInt64(&item.outstanding, 1)
+	return item.sc, func(balancer.DoneInfo) {
+		atomic.AddInt64(&item.outstanding, -1)
+	}, nil
+}
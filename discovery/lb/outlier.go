@@ -0,0 +1,378 @@
+package lb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultOutlierInterval           = 10 * time.Second
+	defaultOutlierMinRequests        = 20
+	defaultOutlierFailureRate        = 0.5
+	defaultOutlierBaseEjectionTime   = 30 * time.Second
+	defaultOutlierMaxEjectionTime    = 5 * time.Minute
+	defaultOutlierMaxEjectionPercent = 10
+)
+
+// outlierFailureCodes are codes of calls counted as failures of instance.
+var outlierFailureCodes = map[codes.Code]bool{
+	codes.Unknown:           true,
+	codes.DeadlineExceeded:  true,
+	codes.ResourceExhausted: true,
+	codes.Internal:          true,
+	codes.Unavailable:       true,
+}
+
+// OutlierConfig configures passive outlier detection.
+// Instances are evaluated every Interval and outliers are ejected from balancing for a time
+// growing with every consecutive ejection.
+type OutlierConfig struct {
+	// Enabled if outlier detection enabled.
+	Enabled bool
+	// Interval of outliers evaluation, 10s by default.
+	Interval time.Duration
+	// MinRequests is number of calls to instance during interval required to evaluate it, 20 by default.
+	MinRequests int
+	// FailureRateThreshold ejects instance which failed calls rate reaches it, 0.5 by default.
+	FailureRateThreshold float64
+	// SlowFactor ejects instance which mean latency exceeds median of mean latencies of instances SlowFactor times.
+	// Latency isn't evaluated if zero.
+	SlowFactor float64
+	// BaseEjectionTime is multiplied by number of consecutive ejections to get ejection time, 30s by default.
+	BaseEjectionTime time.Duration
+	// MaxEjectionTime caps ejection time, 5m by default.
+	MaxEjectionTime time.Duration
+	// MaxEjectionPercent caps percentage of ejected instances, 10 by default. One instance out of several
+	// may be ejected regardless of it.
+	MaxEjectionPercent float64
+}
+
+func (c *OutlierConfig) withDefaults() {
+	if c.Interval <= 0 {
+		c.Interval = defaultOutlierInterval
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = defaultOutlierMinRequests
+	}
+	if c.FailureRateThreshold <= 0 {
+		c.FailureRateThreshold = defaultOutlierFailureRate
+	}
+	if c.BaseEjectionTime <= 0 {
+		c.BaseEjectionTime = defaultOutlierBaseEjectionTime
+	}
+	if c.MaxEjectionTime <= 0 {
+		c.MaxEjectionTime = defaultOutlierMaxEjectionTime
+	}
+	if c.MaxEjectionPercent <= 0 {
+		c.MaxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+}
+
+// Ejection is event of instance ejection or return to balancing.
+type Ejection struct {
+	// Addr is address of instance.
+	Addr string
+	// Ejected is false when instance returns to balancing.
+	Ejected bool
+	// Duration of ejection.
+	Duration time.Duration
+	// FailureRate and MeanLatency are stats of instance which caused ejection.
+	FailureRate float64
+	MeanLatency time.Duration
+}
+
+type outlierDetection struct {
+	cfg        OutlierConfig
+	onEjection func(Ejection)
+}
+
+// pendingDetections holds outlier detections of connections being dialed by names of balancers registered for them.
+// Balancer build options identify connection by dial target only, so every connection detecting outliers gets
+// balancer name of its own, which takes the detection once balancer is built. Names are reused by later connections.
+var pendingDetections = struct {
+	sync.Mutex
+	registered map[string]bool
+	names      map[string]*outlierDetection
+}{registered: map[string]bool{}, names: map[string]*outlierDetection{}}
+
+// WithOutlierDetection returns dial option of balancer name of the package detecting outliers of a single connection,
+// and release func dropping the detection if dial fails before balancer is built. onEjection may be nil.
+func WithOutlierDetection(name string, cfg OutlierConfig, onEjection func(Ejection)) (grpc.DialOption, func(), error) {
+	cfg.withDefaults()
+	if onEjection == nil {
+		onEjection = func(Ejection) {}
+	}
+	od := &outlierDetection{cfg: cfg, onEjection: onEjection}
+
+	pendingDetections.Lock()
+	defer pendingDetections.Unlock()
+	// balancers are registered under the lock, grpc registry isn't thread-safe
+	b, ok := balancer.Get(name).(*builder)
+	if !ok {
+		return nil, nil, errors.Errorf("balancer %q doesn't support outlier detection", name)
+	}
+
+	var connBalancer string
+	for i := 1; ; i++ {
+		connBalancer = fmt.Sprintf("%s#%d", b.name, i)
+		if _, pending := pendingDetections.names[connBalancer]; !pending {
+			break
+		}
+	}
+	if !pendingDetections.registered[connBalancer] {
+		balancer.Register(&builder{name: connBalancer, pb: b.pb, detecting: true})
+		pendingDetections.registered[connBalancer] = true
+	}
+	pendingDetections.names[connBalancer] = od
+
+	release := func() {
+		pendingDetections.Lock()
+		defer pendingDetections.Unlock()
+		if pendingDetections.names[connBalancer] == od {
+			delete(pendingDetections.names, connBalancer)
+		}
+	}
+	return grpc.WithBalancerName(connBalancer), release, nil
+}
+
+// takeDetection removes and returns outlier detection pending for balancer name, nil if there is none.
+func takeDetection(name string) *outlierDetection {
+	pendingDetections.Lock()
+	defer pendingDetections.Unlock()
+
+	od := pendingDetections.names[name]
+	delete(pendingDetections.names, name)
+	return od
+}
+
+type addrStats struct {
+	calls, failures int
+	latency         time.Duration
+	// ejections is number of consecutive ejections, it decreases with every interval instance is healthy
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// detector tracks calls of a connection per instance address and ejects outliers.
+type detector struct {
+	cfg        OutlierConfig
+	onEjection func(Ejection)
+
+	// generation is incremented on every ejection change, so pickers rebuild their instances
+	generation uint64
+
+	lock  sync.Mutex
+	addrs map[string]bool
+	stats map[string]*addrStats
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// newDetector starts detector of outlier detection od.
+func newDetector(od *outlierDetection) *detector {
+	d := &detector{
+		cfg:        od.cfg,
+		onEjection: od.onEjection,
+		addrs:      map[string]bool{},
+		stats:      map[string]*addrStats{},
+		stop:       make(chan struct{}),
+	}
+	go d.run()
+
+	return d
+}
+
+func (d *detector) run() {
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			d.evaluate(now)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// close stops detector and returns ejected instances to balancing, so observers of ejections don't keep them ejected.
+func (d *detector) close() {
+	d.once.Do(func() {
+		var events []Ejection
+		d.lock.Lock()
+		close(d.stop)
+		for addr, st := range d.stats {
+			if !st.ejectedUntil.IsZero() {
+				st.ejectedUntil = time.Time{}
+				events = append(events, Ejection{Addr: addr})
+			}
+		}
+		d.lock.Unlock()
+
+		for _, e := range events {
+			d.onEjection(e)
+		}
+	})
+}
+
+func (d *detector) currentGeneration() uint64 {
+	return atomic.LoadUint64(&d.generation)
+}
+
+// setAddresses sets ready addresses, stats of other addresses are dropped unless they are ejected.
+func (d *detector) setAddresses(addrs []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.addrs = make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		d.addrs[addr] = true
+	}
+	for addr, st := range d.stats {
+		if !d.addrs[addr] && st.ejectedUntil.IsZero() {
+			delete(d.stats, addr)
+		}
+	}
+}
+
+func (d *detector) ejected(addr string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	st, ok := d.stats[addr]
+	return ok && !st.ejectedUntil.IsZero()
+}
+
+func (d *detector) record(addr string, err error, latency time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	st, ok := d.stats[addr]
+	if !ok {
+		st = &addrStats{}
+		d.stats[addr] = st
+	}
+	st.calls++
+	st.latency += latency
+	if err != nil && outlierFailureCodes[status.Code(err)] {
+		st.failures++
+	}
+}
+
+func (d *detector) evaluate(now time.Time) {
+	var events []Ejection
+	d.lock.Lock()
+	select {
+	case <-d.stop:
+		// closed detector has returned all instances already
+		d.lock.Unlock()
+		return
+	default:
+	}
+
+	ejected := 0
+	for addr, st := range d.stats {
+		if st.ejectedUntil.IsZero() {
+			continue
+		}
+		if !now.Before(st.ejectedUntil) {
+			st.ejectedUntil = time.Time{}
+			events = append(events, Ejection{Addr: addr})
+			continue
+		}
+		ejected++
+	}
+
+	type candidate struct {
+		addr        string
+		st          *addrStats
+		failureRate float64
+		meanLatency time.Duration
+	}
+	var candidates []candidate
+	for addr, st := range d.stats {
+		if st.ejectedUntil.IsZero() && st.calls >= d.cfg.MinRequests {
+			candidates = append(candidates, candidate{
+				addr:        addr,
+				st:          st,
+				failureRate: float64(st.failures) / float64(st.calls),
+				meanLatency: st.latency / time.Duration(st.calls),
+			})
+		}
+	}
+
+	var slowLatency time.Duration
+	if d.cfg.SlowFactor > 0 && len(candidates) >= 3 {
+		latencies := make([]time.Duration, 0, len(candidates))
+		for _, c := range candidates {
+			latencies = append(latencies, c.meanLatency)
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		slowLatency = time.Duration(float64(latencies[len(latencies)/2]) * d.cfg.SlowFactor)
+	}
+	// the worst instances are ejected first
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].failureRate != candidates[j].failureRate {
+			return candidates[i].failureRate > candidates[j].failureRate
+		}
+		return candidates[i].meanLatency > candidates[j].meanLatency
+	})
+
+	maxEjected := int(float64(len(d.addrs)) * d.cfg.MaxEjectionPercent / 100)
+	if maxEjected == 0 && len(d.addrs) > 1 {
+		maxEjected = 1
+	}
+	for _, c := range candidates {
+		outlier := c.failureRate >= d.cfg.FailureRateThreshold || (slowLatency > 0 && c.meanLatency > slowLatency)
+		if !outlier {
+			if c.st.ejections > 0 {
+				c.st.ejections--
+			}
+			continue
+		}
+		if ejected >= maxEjected {
+			continue
+		}
+
+		c.st.ejections++
+		duration := d.cfg.BaseEjectionTime * time.Duration(c.st.ejections)
+		if duration > d.cfg.MaxEjectionTime {
+			duration = d.cfg.MaxEjectionTime
+		}
+		c.st.ejectedUntil = now.Add(duration)
+		ejected++
+		events = append(events, Ejection{
+			Addr:        c.addr,
+			Ejected:     true,
+			Duration:    duration,
+			FailureRate: c.failureRate,
+			MeanLatency: c.meanLatency,
+		})
+	}
+
+	for addr, st := range d.stats {
+		st.calls, st.failures, st.latency = 0, 0, 0
+		if !d.addrs[addr] && st.ejectedUntil.IsZero() {
+			delete(d.stats, addr)
+		}
+	}
+	if len(events) > 0 {
+		atomic.AddUint64(&d.generation, 1)
+	}
+	d.lock.Unlock()
+
+	for _, e := range events {
+		d.onEjection(e)
+	}
+}
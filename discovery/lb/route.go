@@ -0,0 +1,163 @@
+package lb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/humans-net/grpc-core/discovery"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// Route selects instances for a call by their tag and version, empty Tag or Version matches any instance.
+// Balancers of the package pick instances of the route set to call context by WithRoute,
+// and fall back to all instances if none of the route is ready.
+type Route struct {
+	Tag     string
+	Version string
+	// Exclude selects instances not matching Tag and Version instead.
+	Exclude bool
+}
+
+// Match checks if instance with attrs belongs to the route.
+func (r Route) Match(attrs discovery.Attributes) bool {
+	match := (r.Tag == "" || attrs.HasTag(r.Tag)) && (r.Version == "" || attrs.Version == r.Version)
+	return match != r.Exclude
+}
+
+type routeKey struct{}
+
+type routeState struct {
+	route    Route
+	fallback int32
+}
+
+// WithRoute makes call made with ctx go to instances of route.
+func WithRoute(ctx context.Context, route Route) context.Context {
+	return context.WithValue(ctx, routeKey{}, &routeState{route: route})
+}
+
+// FellBack checks if call made with ctx went to other instances as none of its route was ready.
+func FellBack(ctx context.Context) bool {
+	state, ok := ctx.Value(routeKey{}).(*routeState)
+	return ok && atomic.LoadInt32(&state.fallback) == 1
+}
+
+// routingPickerBuilder builds pickers choosing instances of call route by inner picker builder.
+// Instances ejected by outlier detector are skipped unless all of them are ejected.
+type routingPickerBuilder struct {
+	inner    base.PickerBuilder
+	detector *detector
+}
+
+func (b *routingPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	p := &routingPicker{
+		inner:    b.inner,
+		detector: b.detector,
+		readySCs: readySCs,
+		addrs:    make(map[balancer.SubConn]string, len(readySCs)),
+	}
+	addrs := make([]string, 0, len(readySCs))
+	for addr, sc := range readySCs {
+		p.addrs[sc] = addr.Addr
+		addrs = append(addrs, addr.Addr)
+	}
+	if p.detector != nil {
+		p.detector.setAddresses(addrs)
+		p.generation = p.detector.currentGeneration()
+	}
+	p.reset()
+
+	return p
+}
+
+// routingPicker lazily builds picker of each route from available instances matching it.
+type routingPicker struct {
+	inner    base.PickerBuilder
+	detector *detector
+	readySCs map[resolver.Address]balancer.SubConn
+	addrs    map[balancer.SubConn]string
+
+	lock sync.Mutex
+	// generation of detector available instances are filtered by
+	generation uint64
+	available  map[resolver.Address]balancer.SubConn
+	all        balancer.Picker
+	routes     map[Route]balancer.Picker
+}
+
+// reset filters out ejected instances and drops pickers built before.
+func (p *routingPicker) reset() {
+	p.available = p.readySCs
+	if p.detector != nil {
+		available := make(map[resolver.Address]balancer.SubConn, len(p.readySCs))
+		for addr, sc := range p.readySCs {
+			if !p.detector.ejected(addr.Addr) {
+				available[addr] = sc
+			}
+		}
+		if len(available) > 0 {
+			p.available = available
+		}
+	}
+	p.all = p.inner.Build(p.available)
+	p.routes = map[Route]balancer.Picker{}
+}
+
+func (p *routingPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	picker := p.picker(ctx)
+	sc, done, err := picker.Pick(ctx, opts)
+	if err != nil || p.detector == nil {
+		return sc, done, err
+	}
+
+	start := time.Now()
+	addr := p.addrs[sc]
+	return sc, func(info balancer.DoneInfo) {
+		if done != nil {
+			done(info)
+		}
+		p.detector.record(addr, info.Err, time.Since(start))
+	}, nil
+}
+
+// picker returns picker of call route, or picker of all instances if no instance of the route is available.
+func (p *routingPicker) picker(ctx context.Context) balancer.Picker {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.detector != nil {
+		if generation := p.detector.currentGeneration(); generation != p.generation {
+			p.generation = generation
+			p.reset()
+		}
+	}
+
+	state, ok := ctx.Value(routeKey{}).(*routeState)
+	if !ok {
+		return p.all
+	}
+
+	picker, ok := p.routes[state.route]
+	if !ok {
+		matched := map[resolver.Address]balancer.SubConn{}
+		for addr, sc := range p.available {
+			if state.route.Match(discovery.AttributesOf(addr)) {
+				matched[addr] = sc
+			}
+		}
+		if len(matched) > 0 {
+			picker = p.inner.Build(matched)
+		}
+		p.routes[state.route] = picker
+	}
+
+	if picker == nil {
+		atomic.StoreInt32(&state.fallback, 1)
+		return p.all
+	}
+	return picker
+}
@@ -0,0 +1,78 @@
+package lb
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+
+	"github.com/humans-net/grpc-core/discovery"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+)
+
+// wrrPickerBuilder builds smooth weighted round robin pickers.
+// If zone is set, only instances of the zone are picked unless none of them is ready.
+type wrrPickerBuilder struct {
+	zone string
+}
+
+func (b *wrrPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	var all, local []*wrrItem
+	for addr, sc := range readySCs {
+		attrs := discovery.AttributesOf(addr)
+		item := &wrrItem{sc: sc, weight: attrs.Weight}
+		all = append(all, item)
+		if b.zone != "" && attrs.Zone == b.zone {
+			local = append(local, item)
+		}
+	}
+
+	items := all
+	if len(local) > 0 {
+		items = local
+	} else if b.zone != "" {
+		grpclog.Infof("no ready instances in zone %s, falling back to %d instances of other zones", b.zone, len(all))
+	}
+	// pickers of different clients shouldn't start from the same instance
+	rand.Shuffle(len(items), func(i, j int) {
+		items[i], items[j] = items[j], items[i]
+	})
+
+	return &wrrPicker{items: items}
+}
+
+type wrrItem struct {
+	sc      balancer.SubConn
+	weight  int
+	current int
+}
+
+// wrrPicker implements smooth weighted round robin, spreading picks of heavy instances evenly.
+type wrrPicker struct {
+	lock  sync.Mutex
+	items []*wrrItem
+}
+
+func (p *wrrPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var best *wrrItem
+	total := 0
+	for _, item := range p.items {
+		item.current += item.weight
+		total += item.weight
+		if best == nil || item.current > best.current {
+			best = item
+		}
+	}
+	best.current -= total
+
+	return best.sc, nil, nil
+}
@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// populate with ld flags
+var (
+	env  string
+	ip   string
+	port string
+)
+
+// Instance is instance of service kept in registry.
+type Instance struct {
+	// ID is unique ID of instance among instances of all services.
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Addr is host:port instance serves at.
+	Addr string            `json:"addr"`
+	Tags []string          `json:"tags,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// LocalInstance returns instance of the running service, its address and tag are populated with ld flags.
+// It panics if port isn't populated, port is checked here rather than on init, so the package can be tested.
+func LocalInstance(name string, meta map[string]string) Instance {
+	if _, err := strconv.Atoi(port); err != nil {
+		panic(fmt.Sprintf("failed to convert port %s string to int: %v", port, err))
+	}
+	return Instance{
+		ID:   fmt.Sprintf("%v-%v-%v", name, ip, port),
+		Name: name,
+		Addr: net.JoinHostPort(ip, port),
+		Tags: []string{env},
+		Meta: meta,
+	}
+}
+
+// Registry registers instances of services and watches instances of other services.
+type Registry interface {
+	// Register registers instance, it stays registered until Deregister.
+	Register(ctx context.Context, instance Instance) error
+	// Deregister removes instance registered by Register.
+	Deregister(ctx context.Context, instance Instance) error
+	// Watch calls onUpdate with healthy instances of service once they are known and on every change until ctx is done.
+	Watch(ctx context.Context, service string, onUpdate func([]Instance)) error
+}
+
+// Addresses converts instances to resolver addresses with Attributes as metadata.
+func Addresses(instances []Instance) []resolver.Address {
+	addrs := make([]resolver.Address, 0, len(instances))
+	for _, instance := range instances {
+		addrs = append(addrs, resolver.Address{
+			Addr:     instance.Addr,
+			Metadata: AttributesFromMeta(instance.Meta, instance.Tags),
+		})
+	}
+	return addrs
+}
+
+// NewNoopRegistry creates registry, which registers nothing and knows no instances.
+// It is used by services running without service discovery, clients of which resolve addresses otherwise.
+func NewNoopRegistry() Registry {
+	return noopRegistry{}
+}
+
+type noopRegistry struct{}
+
+func (noopRegistry) Register(context.Context, Instance) error {
+	return nil
+}
+
+func (noopRegistry) Deregister(context.Context, Instance) error {
+	return nil
+}
+
+func (noopRegistry) Watch(_ context.Context, _ string, onUpdate func([]Instance)) error {
+	onUpdate(nil)
+	return nil
+}
+
+// NewResolverBuilder creates builder of resolvers of target <scheme>:///<service> watching instances in registry.
+func NewResolverBuilder(scheme string, registry Registry) resolver.Builder {
+	return &registryBuilder{scheme: scheme, registry: registry}
+}
+
+type registryBuilder struct {
+	scheme   string
+	registry Registry
+}
+
+func (b *registryBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOption) (resolver.Resolver, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	err := b.registry.Watch(ctx, target.Endpoint, func(instances []Instance) {
+		cc.UpdateState(resolver.State{Addresses: Addresses(instances)})
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return registryResolver(cancel), nil
+}
+
+func (b *registryBuilder) Scheme() string {
+	return b.scheme
+}
+
+// registryResolver stops watch of registry on close.
+type registryResolver context.CancelFunc
+
+func (r registryResolver) ResolveNow(resolver.ResolveNowOption) {}
+
+func (r registryResolver) Close() {
+	r()
+}
@@ -0,0 +1,50 @@
+// Package static implements resolver of fixed addresses listed in target, e.g. static:///localhost:9000,localhost:9001.
+package static
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme of static resolver.
+const Scheme = "static"
+
+// RegisterResolver registers static resolver.
+func RegisterResolver() {
+	resolver.Register(&builder{})
+}
+
+// Target builds dial target of addrs.
+func Target(addrs []string) string {
+	return Scheme + ":///" + strings.Join(addrs, ",")
+}
+
+type builder struct{}
+
+func (*builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOption) (resolver.Resolver, error) {
+	var addrs []resolver.Address
+	for _, addr := range strings.Split(target.Endpoint, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, resolver.Address{Addr: addr})
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no addresses in target %q", target.Endpoint)
+	}
+
+	cc.UpdateState(resolver.State{Addresses: addrs})
+	return staticResolver{}, nil
+}
+
+func (*builder) Scheme() string {
+	return Scheme
+}
+
+// staticResolver has nothing to do as addresses never change.
+type staticResolver struct{}
+
+func (staticResolver) ResolveNow(resolver.ResolveNowOption) {}
+
+func (staticResolver) Close() {}
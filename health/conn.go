@@ -0,0 +1,91 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ConnMonitor tracks connectivity state of grpc client connection.
+// As Checker it fails when connection is shut down or is connecting without becoming READY longer than allowed.
+// Broken connection cycles between TRANSIENT_FAILURE and CONNECTING, so it is failed by time it left READY or IDLE.
+type ConnMonitor struct {
+	cc         *grpc.ClientConn
+	stuckAfter time.Duration
+
+	lock  sync.RWMutex
+	state connectivity.State
+	since time.Time
+	// notReadySince is time connection left READY or IDLE
+	notReadySince time.Time
+}
+
+// MonitorConn starts tracking state of cc until it is shut down, onChange is called on every state transition.
+func MonitorConn(cc *grpc.ClientConn, stuckAfter time.Duration, onChange func(from, to connectivity.State)) *ConnMonitor {
+	now := time.Now()
+	m := &ConnMonitor{
+		cc:            cc,
+		stuckAfter:    stuckAfter,
+		state:         cc.GetState(),
+		since:         now,
+		notReadySince: now,
+	}
+	onChange(connectivity.Idle, m.state)
+
+	go m.watch(onChange)
+	return m
+}
+
+func (m *ConnMonitor) watch(onChange func(from, to connectivity.State)) {
+	state := m.state
+	for state != connectivity.Shutdown {
+		if !m.cc.WaitForStateChange(context.Background(), state) {
+			return
+		}
+
+		next := m.cc.GetState()
+		now := time.Now()
+		m.lock.Lock()
+		if isUsable(state) {
+			m.notReadySince = now
+		}
+		m.state = next
+		m.since = now
+		m.lock.Unlock()
+
+		onChange(state, next)
+		state = next
+	}
+}
+
+// State returns current connectivity state and time it was entered.
+func (m *ConnMonitor) State() (connectivity.State, time.Time) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.state, m.since
+}
+
+// Check implements Checker.
+func (m *ConnMonitor) Check(_ context.Context) error {
+	m.lock.RLock()
+	state, notReadySince := m.state, m.notReadySince
+	m.lock.RUnlock()
+
+	switch {
+	case state == connectivity.Shutdown:
+		return errors.New("connection is shut down")
+	case !isUsable(state) && time.Since(notReadySince) >= m.stuckAfter:
+		return errors.Errorf("connection isn't READY since %s, it is in %s", notReadySince.Format(time.RFC3339), state)
+	default:
+		return nil
+	}
+}
+
+// isUsable reports whether connection in state serves calls or is idle until the next call.
+func isUsable(state connectivity.State) bool {
+	return state == connectivity.Ready || state == connectivity.Idle
+}
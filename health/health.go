@@ -0,0 +1,242 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	defaultTimeout  = time.Second
+	defaultCacheTTL = 5 * time.Second
+	defaultInterval = 10 * time.Second
+)
+
+// Checker checks health of a dependency or of the service itself.
+type Checker interface {
+	// Check returns nil if checked subject is healthy.
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc is an adapter allowing to use ordinary function as Checker.
+type CheckerFunc func(ctx context.Context) error
+
+// Check implements Checker.
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Pinger is implemented by database clients, e.g. *sql.DB.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// Ping creates Checker pinging database.
+func Ping(p Pinger) Checker {
+	return CheckerFunc(p.PingContext)
+}
+
+// Config holds health checks configuration.
+type Config struct {
+	// Timeout of single check, 1s by default.
+	Timeout time.Duration
+	// CacheTTL is duration check result is reused for, 5s by default.
+	CacheTTL time.Duration
+	// Interval between readiness evaluations reflected into grpc health status, 10s by default.
+	Interval time.Duration
+}
+
+func (c *Config) withDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = defaultCacheTTL
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultInterval
+	}
+}
+
+// Report is result of readiness or liveness evaluation.
+type Report struct {
+	Healthy bool `json:"healthy"`
+	// Checks holds "ok" or error message per check name.
+	Checks map[string]string `json:"checks"`
+}
+
+// Registry aggregates registered checks into readiness and liveness.
+type Registry struct {
+	cfg Config
+
+	lock      sync.RWMutex
+	readiness map[string]*check
+	liveness  map[string]*check
+}
+
+// New creates Registry without checks, it is ready and live until checks are added.
+func New(cfg Config) *Registry {
+	cfg.withDefaults()
+
+	return &Registry{
+		cfg:       cfg,
+		readiness: map[string]*check{},
+		liveness:  map[string]*check{},
+	}
+}
+
+// AddReadiness registers check affecting readiness, failing check means service shouldn't receive traffic.
+func (r *Registry) AddReadiness(name string, c Checker) {
+	r.add(r.readiness, name, c, true)
+}
+
+// AddReadinessInfo registers check which result is included into readiness report without affecting readiness.
+func (r *Registry) AddReadinessInfo(name string, c Checker) {
+	r.add(r.readiness, name, c, false)
+}
+
+// AddLiveness registers check affecting liveness, failing check means service should be restarted.
+func (r *Registry) AddLiveness(name string, c Checker) {
+	r.add(r.liveness, name, c, true)
+}
+
+func (r *Registry) add(checks map[string]*check, name string, c Checker, critical bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := checks[name]; ok {
+		panic("health check duplication for name " + name)
+	}
+	checks[name] = &check{checker: c, critical: critical}
+}
+
+// Ready evaluates readiness checks.
+func (r *Registry) Ready(ctx context.Context) Report {
+	return r.evaluate(ctx, r.readiness)
+}
+
+// Live evaluates liveness checks.
+func (r *Registry) Live(ctx context.Context) Report {
+	return r.evaluate(ctx, r.liveness)
+}
+
+func (r *Registry) evaluate(ctx context.Context, checks map[string]*check) Report {
+	r.lock.RLock()
+	snapshot := make(map[string]*check, len(checks))
+	for name, c := range checks {
+		snapshot[name] = c
+	}
+	r.lock.RUnlock()
+
+	type result struct {
+		name     string
+		err      error
+		critical bool
+	}
+	results := make(chan result, len(snapshot))
+	for name, c := range snapshot {
+		go func(name string, c *check) {
+			results <- result{name: name, err: c.run(ctx, r.cfg), critical: c.critical}
+		}(name, c)
+	}
+
+	report := Report{Healthy: true, Checks: make(map[string]string, len(snapshot))}
+	for range snapshot {
+		res := <-results
+		if res.err != nil {
+			report.Healthy = report.Healthy && !res.critical
+			report.Checks[res.name] = res.err.Error()
+			continue
+		}
+		report.Checks[res.name] = "ok"
+	}
+
+	return report
+}
+
+// ReadyHandler serves readiness report, it responds 503 if service isn't ready.
+func (r *Registry) ReadyHandler(w http.ResponseWriter, req *http.Request) {
+	writeReport(w, r.Ready(req.Context()))
+}
+
+// LiveHandler serves liveness report, it responds 503 if service isn't live.
+func (r *Registry) LiveHandler(w http.ResponseWriter, req *http.Request) {
+	writeReport(w, r.Live(req.Context()))
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		grpclog.Errorf("failed to write health report: %v", err)
+	}
+}
+
+// Watch evaluates readiness every interval until ctx is done and calls onChange with the first result
+// and on every readiness change.
+func (r *Registry) Watch(ctx context.Context, onChange func(ready bool, report Report)) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	first := true
+	var ready bool
+	for {
+		report := r.Ready(ctx)
+		if first || report.Healthy != ready {
+			first = false
+			ready = report.Healthy
+			onChange(ready, report)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check runs Checker caching its result.
+type check struct {
+	checker  Checker
+	critical bool
+
+	lock    sync.Mutex
+	err     error
+	checked time.Time
+}
+
+func (c *check) run(ctx context.Context, cfg Config) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.checked.IsZero() && time.Since(c.checked) < cfg.CacheTTL {
+		return c.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.checker.Check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		c.err = err
+	case <-ctx.Done():
+		// checker ignoring context must not block probes
+		c.err = errors.Wrap(ctx.Err(), "health check timed out")
+	}
+	c.checked = time.Now()
+
+	return c.err
+}
@@ -37,7 +37,7 @@ func Init(loader config.Loader) *zap.Logger {
 	case "dev":
 		l, err = zap.NewDevelopment(opts...)
 	default:
-		panic(fmt.Sprintf("unexpected logger type %s want `prod` or `dev`"))
+		panic(fmt.Sprintf("unexpected logger type %s want `prod` or `dev`", cfg.Type))
 	}
 
 	if err != nil {
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Config holds metrics configuration.
+type Config struct {
+	// Namespace prefixes names of metrics created by Registry, sanitized service name by default.
+	Namespace string
+	// Env is value of env constant label, label is omitted if empty.
+	Env string
+	// Push configures pushing of metrics to Pushgateway.
+	Push PushConfig
+	// IncludeDefaultRegistry exposes and pushes metrics registered in prometheus default registry too,
+	// metrics with names the registry has, e.g. Go runtime ones, are dropped.
+	IncludeDefaultRegistry bool
+}
+
+// Registry is prometheus registry of a single server.
+// Every metric registered in it gets service and env constant labels.
+type Registry struct {
+	registerer prometheus.Registerer
+	gatherer   prometheus.Gatherer
+	handler    http.Handler
+	namespace  string
+}
+
+// New creates Registry for service with Go runtime and process collectors registered.
+func New(service string, cfg Config) *Registry {
+	labels := prometheus.Labels{"service": service}
+	if cfg.Env != "" {
+		labels["env"] = cfg.Env
+	}
+
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = sanitize(service)
+	}
+
+	reg := prometheus.NewRegistry()
+	r := &Registry{
+		registerer: prometheus.WrapRegistererWith(labels, reg),
+		gatherer:   reg,
+		namespace:  namespace,
+	}
+	if cfg.IncludeDefaultRegistry {
+		r.gatherer = &withDefaultGatherer{own: reg}
+	}
+	r.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	// handler is built once as its metrics can be registered only once
+	r.handler = promhttp.InstrumentMetricHandler(r.registerer, promhttp.HandlerFor(r.gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}))
+
+	return r
+}
+
+// Registerer returns prometheus.Registerer adding constant labels of the registry.
+func (r *Registry) Registerer() prometheus.Registerer {
+	return r.registerer
+}
+
+// Gatherer returns prometheus.Gatherer of the registry, which also gathers metrics of prometheus default registry
+// if Config.IncludeDefaultRegistry is set.
+func (r *Registry) Gatherer() prometheus.Gatherer {
+	return r.gatherer
+}
+
+// Handler returns http.Handler exposing metrics of the registry.
+// OpenMetrics format is negotiated to expose exemplars.
+func (r *Registry) Handler() http.Handler {
+	return r.handler
+}
+
+// MustRegister registers collectors and panics on error.
+func (r *Registry) MustRegister(cs ...prometheus.Collector) {
+	r.registerer.MustRegister(cs...)
+}
+
+// Counter creates and registers namespaced counter.
+func (r *Registry) Counter(subsystem, name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: r.namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	r.MustRegister(c)
+
+	return c
+}
+
+// Gauge creates and registers namespaced gauge.
+func (r *Registry) Gauge(subsystem, name, help string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: r.namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	r.MustRegister(g)
+
+	return g
+}
+
+// Histogram creates and registers namespaced histogram, nil buckets means prometheus.DefBuckets.
+func (r *Registry) Histogram(subsystem, name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: r.namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}, labels)
+	r.MustRegister(h)
+
+	return h
+}
+
+// withDefaultGatherer gathers metrics of own registry and of prometheus default registry missing in own one.
+type withDefaultGatherer struct {
+	own prometheus.Gatherer
+}
+
+func (g *withDefaultGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.own.Gather()
+	if err != nil {
+		return mfs, err
+	}
+	defaultMfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return mfs, errors.Wrap(err, "failed to gather default registry")
+	}
+
+	names := make(map[string]bool, len(mfs))
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	for _, mf := range defaultMfs {
+		if !names[mf.GetName()] {
+			mfs = append(mfs, mf)
+		}
+	}
+	sort.Slice(mfs, func(i, j int) bool {
+		return mfs[i].GetName() < mfs[j].GetName()
+	})
+
+	return mfs, nil
+}
+
+// sanitize makes metric name component from service name.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func gatheredNames(t *testing.T, g prometheus.Gatherer) map[string]bool {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	names := make(map[string]bool, len(mfs))
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	return names
+}
+
+func TestGathererDefaultRegistry(t *testing.T) {
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_default_total", Help: "Test counter."})
+	prometheus.MustRegister(c)
+	defer prometheus.Unregister(c)
+
+	if gatheredNames(t, New("svc", Config{}).Gatherer())["test_default_total"] {
+		t.Error("metric of default registry is gathered without IncludeDefaultRegistry")
+	}
+	if !gatheredNames(t, New("svc", Config{IncludeDefaultRegistry: true}).Gatherer())["test_default_total"] {
+		t.Error("metric of default registry isn't gathered with IncludeDefaultRegistry")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := New("svc", Config{})
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"google.golang.org/grpc/grpclog"
+)
+
+const defaultPushInterval = 15 * time.Second
+
+// PushConfig configures pushing of metrics to Pushgateway for jobs that do not live long enough to be scraped.
+// Jobs that don't call Server.Serve push their last metrics by Server.PushMetrics.
+type PushConfig struct {
+	// Enabled if metrics are pushed.
+	Enabled bool
+	// URL of Pushgateway.
+	URL string
+	// Job is job grouping label, service name by default.
+	Job string
+	// Instance is instance grouping label, hostname by default.
+	Instance string
+	// Grouping holds additional grouping labels.
+	Grouping map[string]string
+	// Interval between pushes, 15s by default.
+	Interval time.Duration
+	// Timeout of single push, Interval by default.
+	Timeout time.Duration
+}
+
+// Validate implements config.Validatable.
+func (c PushConfig) Validate() error {
+	if c.Enabled && c.URL == "" {
+		return errors.New("pushgateway url is required")
+	}
+	return nil
+}
+
+// Pusher periodically pushes metrics of Registry to Pushgateway.
+type Pusher struct {
+	pusher   *push.Pusher
+	interval time.Duration
+}
+
+// NewPusher creates Pusher of registry metrics for service.
+func (r *Registry) NewPusher(service string, cfg PushConfig) (*Pusher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Job == "" {
+		cfg.Job = service
+	}
+	if cfg.Instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get hostname for instance grouping label")
+		}
+		cfg.Instance = hostname
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultPushInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = cfg.Interval
+	}
+
+	p := push.New(cfg.URL, cfg.Job).
+		Gatherer(r.Gatherer()).
+		Client(&http.Client{Timeout: cfg.Timeout}).
+		Grouping("instance", cfg.Instance)
+	for name, value := range cfg.Grouping {
+		p = p.Grouping(name, value)
+	}
+
+	return &Pusher{pusher: p, interval: cfg.Interval}, nil
+}
+
+// Push pushes metrics once, replacing previously pushed metrics of the same grouping.
+func (p *Pusher) Push() error {
+	if err := p.pusher.Push(); err != nil {
+		return errors.Wrap(err, "failed to push metrics")
+	}
+	return nil
+}
+
+// Run pushes metrics every interval until ctx is done.
+func (p *Pusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Push(); err != nil {
+				grpclog.Errorf("%v", err)
+			}
+		}
+	}
+}
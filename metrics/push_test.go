@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// pushgateway records pushes it receives.
+type pushgateway struct {
+	*httptest.Server
+	mu     sync.Mutex
+	pushes []pushRequest
+}
+
+type pushRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+func newPushgateway() *pushgateway {
+	g := &pushgateway{}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		g.mu.Lock()
+		g.pushes = append(g.pushes, pushRequest{method: r.Method, path: r.URL.Path, body: string(body)})
+		g.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return g
+}
+
+func (g *pushgateway) received() []pushRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]pushRequest(nil), g.pushes...)
+}
+
+func newTestPusher(t *testing.T, url string, interval time.Duration) *Pusher {
+	reg := New("svc", Config{})
+	reg.Counter("test", "pushed_total", "Test counter.").WithLabelValues().Inc()
+
+	p, err := reg.NewPusher("svc", PushConfig{Enabled: true, URL: url, Instance: "host-1", Interval: interval})
+	if err != nil {
+		t.Fatalf("NewPusher: %v", err)
+	}
+	return p
+}
+
+func TestPusherPush(t *testing.T) {
+	g := newPushgateway()
+	defer g.Close()
+
+	if err := newTestPusher(t, g.URL, time.Hour).Push(); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	pushes := g.received()
+	if len(pushes) != 1 {
+		t.Fatalf("got %d pushes, want 1", len(pushes))
+	}
+	p := pushes[0]
+	if p.method != http.MethodPut {
+		t.Errorf("method = %s, want PUT", p.method)
+	}
+	if want := "/metrics/job/svc/instance/host-1"; p.path != want {
+		t.Errorf("path = %s, want %s", p.path, want)
+	}
+
+	families := map[string]*dto.MetricFamily{}
+	dec := expfmt.NewDecoder(strings.NewReader(p.body), expfmt.FmtProtoDelim)
+	for {
+		family := &dto.MetricFamily{}
+		if err := dec.Decode(family); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("decode pushed metrics: %v", err)
+		}
+		families[family.GetName()] = family
+	}
+	family, ok := families["svc_test_pushed_total"]
+	if !ok {
+		t.Fatalf("svc_test_pushed_total isn't pushed")
+	}
+	if v := family.GetMetric()[0].GetCounter().GetValue(); v != 1 {
+		t.Errorf("svc_test_pushed_total = %v, want 1", v)
+	}
+}
+
+func TestPusherPushError(t *testing.T) {
+	g := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer g.Close()
+
+	if err := newTestPusher(t, g.URL, time.Hour).Push(); err == nil {
+		t.Fatal("Push succeeded, want error of failed push")
+	}
+}
+
+func TestPusherRun(t *testing.T) {
+	g := newPushgateway()
+	defer g.Close()
+
+	p := newTestPusher(t, g.URL, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(g.received()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d pushes, want periodic pushes", len(g.received()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after ctx is done")
+	}
+	n := len(g.received())
+	time.Sleep(50 * time.Millisecond)
+	if got := len(g.received()); got != n {
+		t.Errorf("got %d pushes after Run returned, want none", got-n)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/humans-net/grpc-core/breaker"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/status"
+)
+
+// allMethods is method label of circuit breaker shared by all methods of connection.
+const allMethods = "all"
+
+var defaultBreakerFailureCodes = []string{"UNKNOWN", "DEADLINE_EXCEEDED", "RESOURCE_EXHAUSTED", "INTERNAL", "UNAVAILABLE"}
+
+// CircuitBreakerConfig configures circuit breaker of client connection, thresholds are inlined into it.
+type CircuitBreakerConfig struct {
+	breaker.Config `key:",squash"`
+	// Enabled if circuit breaker enabled.
+	Enabled bool
+	// PerMethod makes every method have its own breaker instead of one breaker of the whole connection.
+	PerMethod bool
+	// FailureCodes are grpc code names counted as failures, UNKNOWN, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED,
+	// INTERNAL and UNAVAILABLE by default.
+	FailureCodes []string
+}
+
+func (c *CircuitBreakerConfig) withDefaults() {
+	if len(c.FailureCodes) == 0 {
+		c.FailureCodes = defaultBreakerFailureCodes
+	}
+}
+
+type breakerMetrics struct {
+	states   *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+}
+
+func newBreakerMetrics(reg prometheus.Registerer) *breakerMetrics {
+	m := &breakerMetrics{
+		states: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "grpc_client_circuit_breaker_state",
+			Help: "State of client circuit breakers, 1 for the current state and 0 for others.",
+		}, []string{"target", "method", "state"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_client_circuit_breaker_rejected_total",
+			Help: "Total number of client calls rejected by open circuit breakers.",
+		}, []string{"target", "method"}),
+	}
+	reg.MustRegister(m.states, m.rejected)
+
+	return m
+}
+
+// clientBreakers holds circuit breakers of connection to target, which is connection name
+// so several connections to the same microservice have metrics of their own.
+type clientBreakers struct {
+	target       string
+	cfg          CircuitBreakerConfig
+	failureCodes map[codes.Code]bool
+	metrics      *breakerMetrics
+
+	lock     sync.Mutex
+	breakers map[string]*breaker.Breaker
+}
+
+func newClientBreakers(target string, cfg CircuitBreakerConfig, metrics *breakerMetrics) (*clientBreakers, error) {
+	failureCodes, err := parseCodes(cfg.FailureCodes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid circuit breaker failure codes of client %s", target)
+	}
+
+	return &clientBreakers{
+		target:       target,
+		cfg:          cfg,
+		failureCodes: failureCodes,
+		metrics:      metrics,
+		breakers:     map[string]*breaker.Breaker{},
+	}, nil
+}
+
+func (b *clientBreakers) breaker(method string) (*breaker.Breaker, string) {
+	if !b.cfg.PerMethod {
+		method = allMethods
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	cb, ok := b.breakers[method]
+	if !ok {
+		cb = breaker.New(b.cfg.Config, func(from, to breaker.State) {
+			b.metrics.states.WithLabelValues(b.target, method, from.String()).Set(0)
+			b.metrics.states.WithLabelValues(b.target, method, to.String()).Set(1)
+			grpclog.Infof("circuit breaker of %s method %s changed state from %s to %s", b.target, method, from, to)
+		})
+		b.metrics.states.WithLabelValues(b.target, method, breaker.Closed.String()).Set(1)
+		b.breakers[method] = cb
+	}
+	return cb, method
+}
+
+// allow returns function reporting result of the call or Unavailable error if breaker is open.
+// DEADLINE_EXCEEDED isn't failure of the target if deadline of the call was set by the inbound call.
+func (b *clientBreakers) allow(ctx context.Context, method string) (func(err error, duration time.Duration), error) {
+	cb, label := b.breaker(method)
+	done, err := cb.Allow()
+	if err != nil {
+		b.metrics.rejected.WithLabelValues(b.target, label).Inc()
+		return nil, status.Errorf(codes.Unavailable, "circuit breaker of %s is open", b.target)
+	}
+
+	return func(err error, duration time.Duration) {
+		code := status.Code(err)
+		done(b.failureCodes[code] && !(code == codes.DeadlineExceeded && cappedByInbound(ctx)), duration)
+	}, nil
+}
+
+func (b *clientBreakers) unaryClientInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	done, err := b.allow(ctx, method)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = invoker(ctx, method, req, reply, cc, opts...)
+	done(err, time.Since(start))
+	return err
+}
+
+// streamClientInterceptor accounts stream creation only, stream duration isn't tracked as it's unbounded.
+func (b *clientBreakers) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	done, err := b.allow(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	done(err, 0)
+	return stream, err
+}
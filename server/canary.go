@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+
+	"github.com/humans-net/grpc-core/discovery/lb"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	routeCanary = "canary"
+	routeStable = "stable"
+)
+
+// CanaryConfig routes part of calls to canary instances selected by tag and version of instances.
+// Other calls go to stable instances. Routing requires one of lb balancers, round_robin is replaced by weighted_round_robin.
+type CanaryConfig struct {
+	// Tag of canary instances.
+	Tag string
+	// Version of canary instances.
+	Version string
+	// Percent of calls routed to canary.
+	Percent float64
+	// Header is metadata key routing calls to canary regardless of Percent,
+	// it is looked up in outgoing metadata and then in metadata of the inbound call.
+	Header string
+	// HeaderValue is required value of Header, any value matches if empty.
+	HeaderValue string
+}
+
+// enabled checks if canary instances are configured.
+func (c CanaryConfig) enabled() bool {
+	return c.Tag != "" || c.Version != ""
+}
+
+func newRouteCounter(reg prometheus.Registerer) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_client_routed_total",
+		Help: "Total number of client calls per route, fallback is true if no instance of the route was ready.",
+	}, []string{"target", "route", "fallback"})
+	reg.MustRegister(c)
+
+	return c
+}
+
+// canaryRouter sets route of outgoing calls to target, which is connection name
+// so several connections to the same microservice have metrics of their own.
+type canaryRouter struct {
+	target  string
+	cfg     CanaryConfig
+	counter *prometheus.CounterVec
+}
+
+func newCanaryRouter(target string, cfg CanaryConfig, counter *prometheus.CounterVec) *canaryRouter {
+	cfg.Header = strings.ToLower(cfg.Header)
+	return &canaryRouter{target: target, cfg: cfg, counter: counter}
+}
+
+func (r *canaryRouter) route(ctx context.Context) (context.Context, string) {
+	canary := lb.Route{Tag: r.cfg.Tag, Version: r.cfg.Version}
+	if r.headerMatches(ctx) || rand.Float64()*100 < r.cfg.Percent {
+		return lb.WithRoute(ctx, canary), routeCanary
+	}
+
+	canary.Exclude = true
+	return lb.WithRoute(ctx, canary), routeStable
+}
+
+func (r *canaryRouter) headerMatches(ctx context.Context) bool {
+	if r.cfg.Header == "" {
+		return false
+	}
+
+	var values []string
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		values = md.Get(r.cfg.Header)
+	}
+	if len(values) == 0 {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			values = md.Get(r.cfg.Header)
+		}
+	}
+	for _, v := range values {
+		if r.cfg.HeaderValue == "" || v == r.cfg.HeaderValue {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *canaryRouter) observe(ctx context.Context, route string) {
+	fallback := "false"
+	if lb.FellBack(ctx) {
+		fallback = "true"
+	}
+	r.counter.WithLabelValues(r.target, route, fallback).Inc()
+}
+
+func (r *canaryRouter) unaryClientInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, route := r.route(ctx)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	r.observe(ctx, route)
+	return err
+}
+
+func (r *canaryRouter) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, route := r.route(ctx)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	r.observe(ctx, route)
+	return stream, err
+}
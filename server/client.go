@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
+	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
+	"github.com/humans-net/grpc-core/discovery/consul"
+	"github.com/humans-net/grpc-core/discovery/dns"
+	"github.com/humans-net/grpc-core/discovery/file"
+	"github.com/humans-net/grpc-core/discovery/lb"
+	"github.com/humans-net/grpc-core/discovery/static"
+	"github.com/humans-net/grpc-core/health"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/grpclog"
+)
+
+func newConnStateGauge(reg prometheus.Registerer) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpc_client_connection_state",
+		Help: "Connectivity state of client connections, 1 for the current state and 0 for others. Target is microservice name, n-th connection to it is labeled name#n.",
+	}, []string{"target", "state"})
+	reg.MustRegister(g)
+
+	return g
+}
+
+// clientConfig loads configuration of connection to microservice msName.
+func (s *Server) clientConfig(msName string) ClientConfig {
+	cfg := ClientConfig{}
+	if err := s.loader.Load("Clients."+msName, &cfg); err != nil {
+		s.log.Sugar().Infof("client %s not configured, using defaults: %v", msName, err)
+	}
+	cfg.withDefaults()
+	if cfg.Scheme == "" {
+		cfg.Scheme = s.registryScheme
+	}
+
+	return cfg
+}
+
+// connName names connection to msName in checks and metrics, n-th connection to the same microservice is named msName#n.
+func (s *Server) connName(msName string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conns[msName]++
+	return nthConnName(msName, s.conns[msName])
+}
+
+// releaseConnName releases name of connection to msName which failed to be dialed,
+// unless other connections to msName were named after it.
+func (s *Server) releaseConnName(msName, connName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if n := s.conns[msName]; n > 0 && nthConnName(msName, n) == connName {
+		s.conns[msName]--
+	}
+}
+
+func nthConnName(msName string, n int) string {
+	if n > 1 {
+		return fmt.Sprintf("%s#%d", msName, n)
+	}
+	return msName
+}
+
+// monitorConn registers connection named connName as dependency of the server.
+// Connectivity state is exported as metric and reported by readiness check, which fails for critical dependencies only.
+func (s *Server) monitorConn(connName string, cc *grpc.ClientConn, cfg ClientConfig) {
+	m := health.MonitorConn(cc, cfg.CriticalAfter, func(from, to connectivity.State) {
+		s.connStates.WithLabelValues(connName, from.String()).Set(0)
+		s.connStates.WithLabelValues(connName, to.String()).Set(1)
+		if from != to {
+			s.log.Sugar().Infof("connection to %s changed state from %s to %s", connName, from, to)
+		}
+	})
+
+	checkName := "grpc:" + connName
+	if cfg.Critical {
+		s.checks.AddReadiness(checkName, m)
+	} else {
+		s.checks.AddReadinessInfo(checkName, m)
+	}
+}
+
+const defaultDialTimeout = 10 * time.Second
+
+// ClientOption configures connection created by ConnectContext.
+type ClientOption func(o *clientOptions)
+
+type clientOptions struct {
+	block        bool
+	dialTimeout  time.Duration
+	creds        credentials.TransportCredentials
+	unary        []grpc.UnaryClientInterceptor
+	stream       []grpc.StreamClientInterceptor
+	callTimeout  time.Duration
+	scheme       string
+	critical     *bool
+	extraOptions []grpc.DialOption
+}
+
+// WithNonBlocking makes ConnectContext return immediately, connection is established in background.
+func WithNonBlocking() ClientOption {
+	return func(o *clientOptions) {
+		o.block = false
+	}
+}
+
+// WithDialTimeout limits time of blocking dial, 10s by default. Zero means ctx deadline only.
+func WithDialTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.dialTimeout = d
+	}
+}
+
+// WithTLS secures connection by creds, connection is insecure by default,
+// unless consul connect is enabled and target is resolved by consul, or client is configured with Connect.
+func WithTLS(creds credentials.TransportCredentials) ClientOption {
+	return func(o *clientOptions) {
+		o.creds = creds
+	}
+}
+
+// WithUnaryInterceptors appends interceptors after the default ones.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryClientInterceptor) ClientOption {
+	return func(o *clientOptions) {
+		o.unary = append(o.unary, interceptors...)
+	}
+}
+
+// WithStreamInterceptors appends stream interceptors.
+func WithStreamInterceptors(interceptors ...grpc.StreamClientInterceptor) ClientOption {
+	return func(o *clientOptions) {
+		o.stream = append(o.stream, interceptors...)
+	}
+}
+
+// WithDefaultCallTimeout sets deadline of calls made without one, it overrides Timeout of client configuration.
+func WithDefaultCallTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.callTimeout = d
+	}
+}
+
+// WithScheme overrides resolver scheme of client configuration.
+func WithScheme(scheme string) ClientOption {
+	return func(o *clientOptions) {
+		o.scheme = scheme
+	}
+}
+
+// WithCritical overrides Critical of client configuration.
+func WithCritical(critical bool) ClientOption {
+	return func(o *clientOptions) {
+		o.critical = &critical
+	}
+}
+
+// WithDialOptions appends raw grpc dial options.
+func WithDialOptions(opts ...grpc.DialOption) ClientOption {
+	return func(o *clientOptions) {
+		o.extraOptions = append(o.extraOptions, opts...)
+	}
+}
+
+// ConnectContext connects to microservice msName resolved by registry of the server unless other scheme is set.
+// Connection is closed on exit and monitored as dependency of the server.
+func (s *Server) ConnectContext(ctx context.Context, msName string, opts ...ClientOption) (*grpc.ClientConn, error) {
+	clientCfg := s.clientConfig(msName)
+
+	o := &clientOptions{
+		block:       true,
+		dialTimeout: defaultDialTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.scheme != "" {
+		clientCfg.Scheme = o.scheme
+	}
+	if o.critical != nil {
+		clientCfg.Critical = *o.critical
+	}
+	if clientCfg.Scheme == file.Scheme && s.servicesFile == "" {
+		return nil, errors.Errorf("client %s is resolved by file scheme, but Discovery.File isn't configured", msName)
+	}
+
+	unary := []grpc.UnaryClientInterceptor{
+		grpc_zap.UnaryClientInterceptor(s.log, []grpc_zap.Option{grpc_zap.WithLevels(codeToLevel)}...),
+		grpc_zap.PayloadUnaryClientInterceptor(s.log, s.clientPayloadLoggingDecider),
+		s.clientMetrics.UnaryClientInterceptor(),
+		s.clientLatency.unaryClientInterceptor,
+		grpc_opentracing.UnaryClientInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer())),
+	}
+	if o.callTimeout > 0 {
+		clientCfg.Timeout = o.callTimeout
+	}
+	deadlines := newClientDeadlines(clientCfg)
+	unary = append([]grpc.UnaryClientInterceptor{deadlines.unaryClientInterceptor}, unary...)
+	stream := []grpc.StreamClientInterceptor{
+		deadlines.streamClientInterceptor,
+		grpc_zap.StreamClientInterceptor(s.log, []grpc_zap.Option{grpc_zap.WithLevels(codeToLevel)}...),
+		s.clientMetrics.StreamClientInterceptor(),
+		grpc_opentracing.StreamClientInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer())),
+	}
+
+	if balancer.Get(clientCfg.Balancer) == nil {
+		return nil, errors.Errorf("unknown balancer %q of client %s", clientCfg.Balancer, msName)
+	}
+
+	creds := o.creds
+	if creds == nil && (clientCfg.Connect || s.connect != nil && clientCfg.Scheme == consul.Scheme) {
+		if s.connect == nil {
+			return nil, errors.Errorf("client %s requires Consul.Connect enabled", msName)
+		}
+		creds = credentials.NewTLS(s.connect.ClientTLSConfig(msName))
+	}
+	scOpts, err := s.serviceConfigOptions(msName, clientCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// name and outlier detection of the connection are released unless it is dialed
+	connName := s.connName(msName)
+	releaseDetection := func() {}
+	dialed := false
+	defer func() {
+		if !dialed {
+			releaseDetection()
+			s.releaseConnName(msName, connName)
+		}
+	}()
+
+	target := s.target(msName, clientCfg)
+	balancerOpt := grpc.WithBalancerName(clientCfg.Balancer)
+	if clientCfg.OutlierDetection.Enabled {
+		opt, release, err := lb.WithOutlierDetection(clientCfg.Balancer, clientCfg.OutlierDetection, s.onEjection(connName))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid outlier detection of client %s", msName)
+		}
+		balancerOpt, releaseDetection = opt, release
+	}
+
+	if clientCfg.Canary.enabled() {
+		router := newCanaryRouter(connName, clientCfg.Canary, s.routeCounter)
+		unary = append(unary, router.unaryClientInterceptor)
+		stream = append(stream, router.streamClientInterceptor)
+	}
+
+	if clientCfg.CircuitBreaker.Enabled {
+		breakers, err := newClientBreakers(connName, clientCfg.CircuitBreaker, s.breakerMetrics)
+		if err != nil {
+			return nil, err
+		}
+		unary = append(unary, breakers.unaryClientInterceptor)
+		stream = append(stream, breakers.streamClientInterceptor)
+	}
+
+	connOpts := []grpc.DialOption{
+		balancerOpt,
+		grpc.WithChainUnaryInterceptor(append(unary, o.unary...)...),
+		grpc.WithChainStreamInterceptor(append(stream, o.stream...)...),
+	}
+	if creds != nil {
+		connOpts = append(connOpts, grpc.WithTransportCredentials(creds))
+	} else {
+		connOpts = append(connOpts, grpc.WithInsecure())
+	}
+	if o.block {
+		connOpts = append(connOpts, grpc.WithBlock())
+		if o.dialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, o.dialTimeout)
+			defer cancel()
+		}
+	}
+	connOpts = append(connOpts, scOpts...)
+	connOpts = append(connOpts, o.extraOptions...)
+
+	clientConn, err := grpc.DialContext(ctx, target, connOpts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", target)
+	}
+	dialed = true
+	s.AddExitFunc(func(_ int) {
+		if err := clientConn.Close(); err != nil {
+			grpclog.Errorf("failed to close client conn to %s: %v", msName, err)
+		}
+		// outlier detection is pending if connection was closed before its balancer was built
+		releaseDetection()
+	})
+	s.monitorConn(connName, clientConn, clientCfg)
+
+	return clientConn, nil
+}
+
+// target builds dial target of msName for resolver scheme of cfg.
+func (s *Server) target(msName string, cfg ClientConfig) string {
+	switch cfg.Scheme {
+	case consul.Scheme:
+		return fmt.Sprintf("%s://%s/%s", consul.Scheme, s.consulCfg.Endpoint, msName)
+	case static.Scheme:
+		return static.Target(cfg.Addresses)
+	case dns.Scheme:
+		if len(cfg.Addresses) > 0 {
+			return fmt.Sprintf("%s:///%s", dns.Scheme, cfg.Addresses[0])
+		}
+	}
+	return fmt.Sprintf("%s:///%s", cfg.Scheme, msName)
+}
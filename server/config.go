@@ -1,9 +1,28 @@
 package server
 
+import (
+	"time"
+
+	"github.com/humans-net/grpc-core/discovery/lb"
+	"google.golang.org/grpc/balancer/roundrobin"
+)
+
+const defaultCriticalAfter = 30 * time.Second
+
 type Config struct {
 	Name        string
 	Endpoint    string
 	LogPayloads *bool
+	// HistogramBuckets are latency buckets in seconds of grpc server and http histograms, prometheus.DefBuckets by default.
+	HistogramBuckets []float64
+	// MethodHistogramBuckets overrides HistogramBuckets of grpc server latency histogram per method.
+	MethodHistogramBuckets []MethodBuckets
+	// ClientHistogramBuckets are latency buckets in seconds of grpc client histogram, HistogramBuckets by default.
+	ClientHistogramBuckets []float64
+	// ClientMethodHistogramBuckets overrides ClientHistogramBuckets of grpc client latency histogram per method.
+	ClientMethodHistogramBuckets []MethodBuckets
+	// DebugTrace allows to force tracing and payload logging of single requests.
+	DebugTrace DebugTraceConfig
 }
 
 func (c *Config) withDefaults() {
@@ -11,4 +30,84 @@ func (c *Config) withDefaults() {
 		t := true
 		c.LogPayloads = &t
 	}
+	if len(c.ClientHistogramBuckets) == 0 {
+		c.ClientHistogramBuckets = c.HistogramBuckets
+	}
+	c.DebugTrace.withDefaults()
+}
+
+// DiscoveryConfig configures registry of the server and resolvers registered next to registry one,
+// it is loaded from Discovery key.
+type DiscoveryConfig struct {
+	// Registry is registry the server registers to and resolves clients by default, one of consul (default), dir or none.
+	// Consul key is loaded for consul registry only. Clients of server without registry need other resolver scheme.
+	Registry string
+	// Dir is directory of dir registry.
+	Dir string
+	// Meta is service meta of registered instance for registries other than consul, which uses Consul.Meta.
+	Meta map[string]string
+	// File is path of YAML or JSON file listing instances of services for file resolver.
+	File string
+	// DNSRefresh is re-resolution interval of dnssrv resolver, 30s by default.
+	DNSRefresh time.Duration
+}
+
+// ClientConfig holds configuration of connection to microservice, it is loaded from Clients.<name> key.
+type ClientConfig struct {
+	// Critical if server isn't ready while connection is broken.
+	Critical bool
+	// CriticalAfter is how long connection may stay not READY while connecting before it is considered broken, 30s by default.
+	CriticalAfter time.Duration
+	// Scheme is resolver scheme, one of consul, dir, static, dnssrv or file, scheme of registry of the server by default.
+	// dns scheme is grpc dns resolver, it resolves service name as host.
+	Scheme string
+	// Addresses are addresses of static resolver, or name resolved by dnssrv resolver.
+	// Name is looked up in SRV records if it has no port, service name is resolved if empty.
+	Addresses []string
+	// Connect dials target with consul connect certificates of the server whatever its scheme is,
+	// e.g. connect service resolved by static or dnssrv resolver. It requires Consul.Connect,
+	// targets resolved by consul are dialed with the certificates once Consul.Connect is set.
+	Connect bool
+	// Balancer is grpc balancer name, round_robin by default.
+	// Balancers of lb package use zone and weight from service meta of instances.
+	Balancer string
+	// Canary routes part of calls to canary instances.
+	Canary CanaryConfig
+	// OutlierDetection ejects failing or slow instances from balancing, it requires one of lb balancers.
+	OutlierDetection lb.OutlierConfig
+	// Methods are call policies applied as default grpc service config of the connection.
+	// Service config provided by resolver, e.g. stored in consul, replaces them as a whole.
+	Methods []MethodConfig
+	// Timeout is default deadline of unary calls made without one, Methods override it per method.
+	Timeout time.Duration
+	// DeadlineMargin is subtracted from remaining deadline of inbound call to get deadline of outgoing calls, 10ms by default.
+	DeadlineMargin time.Duration
+	// CircuitBreaker fails calls fast while target is degraded.
+	CircuitBreaker CircuitBreakerConfig
+}
+
+func (c *DiscoveryConfig) withDefaults() {
+	if c.Registry == "" {
+		c.Registry = RegistryConsul
+	}
+}
+
+func (c *ClientConfig) withDefaults() {
+	if c.CriticalAfter <= 0 {
+		c.CriticalAfter = defaultCriticalAfter
+	}
+	if c.Balancer == "" {
+		c.Balancer = roundrobin.Name
+	}
+	// round_robin doesn't respect routes and ejections, weighted_round_robin behaves the same for instances without weight
+	if (c.Canary.enabled() || c.OutlierDetection.Enabled) && c.Balancer == roundrobin.Name {
+		c.Balancer = lb.WeightedRoundRobin
+	}
+	if c.DeadlineMargin <= 0 {
+		c.DeadlineMargin = defaultDeadlineMargin
+	}
+	c.CircuitBreaker.withDefaults()
+	for i := range c.Methods {
+		c.Methods[i].withDefaults()
+	}
 }
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"context"
+
+	"github.com/humans-net/grpc-core/discovery/consul"
+)
+
+// initConnect loads consul connect certificates of the service, they are watched until Serve stops.
+// Expired leaf certificate makes the server not ready, as clients can't connect to it.
+func (s *Server) initConnect() {
+	if !s.consulCfg.Connect {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connect, err := consul.NewConnect(ctx, s.consulCfg)
+	if err != nil {
+		s.log.Sugar().Panicf("failed to load consul connect certificates: %v", err)
+	}
+	s.connect, s.stopConnect = connect, cancel
+	s.checks.AddReadiness("consul:connect", connect)
+}
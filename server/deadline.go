@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultDeadlineMargin = 10 * time.Millisecond
+
+type inboundDeadlineKey struct{}
+
+// inboundCappedKey marks outgoing call ctx, which deadline is the inbound one less margin rather than its own timeout.
+type inboundCappedKey struct{}
+
+// deadlineUnaryServerInterceptor remembers deadline of inbound call, so outgoing calls made while handling it
+// can leave time for the handler to process their results.
+func deadlineUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		ctx = context.WithValue(ctx, inboundDeadlineKey{}, deadline)
+	}
+	return handler(ctx, req)
+}
+
+// inboundDeadline returns deadline of the inbound call ctx belongs to.
+func inboundDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(inboundDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+// cappedByInbound reports whether deadline of outgoing call ctx is set by deadline of the inbound call,
+// so exceeding it is caused by the caller rather than by the target.
+func cappedByInbound(ctx context.Context) bool {
+	capped, _ := ctx.Value(inboundCappedKey{}).(bool)
+	return capped
+}
+
+// clientDeadlines sets deadlines of outgoing calls.
+type clientDeadlines struct {
+	// timeout is default timeout of calls without deadline, zero means no default
+	timeout time.Duration
+	// methods are default timeouts per full method name or service prefix
+	methods  map[string]time.Duration
+	services map[string]time.Duration
+	// margin is subtracted from remaining inbound deadline
+	margin time.Duration
+}
+
+func newClientDeadlines(cfg ClientConfig) *clientDeadlines {
+	d := &clientDeadlines{
+		timeout:  cfg.Timeout,
+		methods:  map[string]time.Duration{},
+		services: map[string]time.Duration{},
+		margin:   cfg.DeadlineMargin,
+	}
+	for _, m := range cfg.Methods {
+		if m.Timeout <= 0 {
+			continue
+		}
+		if m.Method == "" {
+			d.services[m.path()] = m.Timeout
+		} else {
+			d.methods[m.path()] = m.Timeout
+		}
+	}
+
+	return d
+}
+
+func (d *clientDeadlines) methodTimeout(method string) time.Duration {
+	if timeout, ok := d.methods[method]; ok {
+		return timeout
+	}
+	service, _ := splitMethodName(method)
+	if timeout, ok := d.services["/"+service+"/"]; ok {
+		return timeout
+	}
+	return d.timeout
+}
+
+// withDeadline applies default timeout of method to ctx without deadline and caps deadline by the inbound one.
+// It fails with DeadlineExceeded if there is no time left for the call.
+func (d *clientDeadlines) withDeadline(ctx context.Context, method string) (context.Context, context.CancelFunc, error) {
+	now := time.Now()
+	deadline, ok := ctx.Deadline()
+	inbound, hasInbound := inboundDeadline(ctx)
+	if hasInbound && inbound.Equal(deadline) {
+		// the only deadline is the inbound one, method may have shorter default
+		ok = false
+	}
+
+	var target time.Time
+	if ok {
+		target = deadline
+	} else if timeout := d.methodTimeout(method); timeout > 0 {
+		target = now.Add(timeout)
+	}
+	if hasInbound {
+		if capped := inbound.Add(-d.margin); target.IsZero() || capped.Before(target) {
+			target = capped
+			ctx = context.WithValue(ctx, inboundCappedKey{}, true)
+		}
+	}
+
+	if target.IsZero() {
+		return ctx, func() {}, nil
+	}
+	if !target.After(now) {
+		return nil, nil, status.Errorf(codes.DeadlineExceeded, "no time left to call %s", method)
+	}
+	ctx, cancel := context.WithDeadline(ctx, target)
+	return ctx, cancel, nil
+}
+
+func (d *clientDeadlines) unaryClientInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, cancel, err := d.withDeadline(ctx, method)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// streamClientInterceptor caps deadline of streams by the inbound one, default timeouts don't apply to streams.
+func (d *clientDeadlines) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	inbound, ok := inboundDeadline(ctx)
+	if !ok {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+
+	capped := inbound.Add(-d.margin)
+	if !capped.After(time.Now()) {
+		return nil, status.Errorf(codes.DeadlineExceeded, "no time left to call %s", method)
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(capped) {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	// stream outlives the interceptor, so context is released once the stream finishes or its deadline passes
+	ctx, cancel := context.WithDeadline(context.WithValue(ctx, inboundCappedKey{}, true), capped)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &deadlineStream{ClientStream: stream, serverStreams: desc.ServerStreams, cancel: cancel}, nil
+}
+
+// deadlineStream cancels context of the stream once the last message is received.
+type deadlineStream struct {
+	grpc.ClientStream
+	serverStreams bool
+	cancel        context.CancelFunc
+}
+
+func (s *deadlineStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	// stream without server streaming finishes with its single response
+	if err != nil || !s.serverStreams {
+		s.cancel()
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/humans-net/grpc-core/tracer"
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const defaultDebugHeader = "x-debug-trace"
+
+// DebugTraceConfig configures forced tracing and payload logging of single requests.
+// Request is debugged when it carries Header with value "1" (or the Secret) and is allowed
+// either by the Secret or by identity of authenticated caller listed in Callers.
+type DebugTraceConfig struct {
+	// Enabled if debug header is honoured.
+	Enabled bool
+	// Header is metadata key requesting debug, x-debug-trace by default.
+	Header string
+	// Secret is shared secret expected as value of Header.
+	Secret string
+	// Callers is allow-list of caller identities, which are URI SAN or common name of verified TLS client certificate,
+	// e.g. spiffe ID of consul connect service. Callers without client certificate and http requests of the gateway
+	// are allowed by the Secret only.
+	Callers []string
+}
+
+func (c *DebugTraceConfig) withDefaults() {
+	if c.Header == "" {
+		c.Header = defaultDebugHeader
+	}
+	c.Header = strings.ToLower(c.Header)
+}
+
+// allowed checks debug header value and caller identity of the request.
+func (c *DebugTraceConfig) allowed(value, caller string) bool {
+	if !c.Enabled || value == "" {
+		return false
+	}
+
+	if c.Secret != "" && subtle.ConstantTimeCompare([]byte(value), []byte(c.Secret)) == 1 {
+		return true
+	}
+
+	if value != "1" || caller == "" {
+		return false
+	}
+	for _, allowed := range c.Callers {
+		if allowed == caller {
+			return true
+		}
+	}
+
+	return false
+}
+
+type debugKey struct{}
+
+// isDebug reports whether request of the ctx is debugged.
+func isDebug(ctx context.Context) bool {
+	debug, _ := ctx.Value(debugKey{}).(bool)
+	return debug
+}
+
+// debugUnaryServerInterceptor marks requests allowed to be debugged, forces sampling of their spans.
+// It must be placed after tracing and before payload logging interceptors.
+func (s *Server) debugUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if !s.cfg.DebugTrace.allowed(firstValue(md, s.cfg.DebugTrace.Header), s.callerOf(ctx)) {
+		return handler(ctx, req)
+	}
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		tracer.ForceSampling(span)
+	}
+	grpc_ctxtags.Extract(ctx).Set("debug", true)
+
+	return handler(context.WithValue(ctx, debugKey{}, true), req)
+}
+
+// callerOf returns identity of caller authenticated by TLS client certificate, empty if there is none.
+// Client certificates are verified by server TLS, e.g. of consul connect, identity from metadata isn't trusted
+// as any caller is able to set it. Gateway of the server calls it with the server's own certificate
+// on behalf of any http client, so the server itself has no identity and is allowed by the Secret only.
+func (s *Server) callerOf(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return ""
+	}
+
+	cert := info.State.PeerCertificates[0]
+	if s.connect != nil && s.connect.IsSelf(cert) {
+		return ""
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
+
+// debugMetadata forwards debug header of gateway http request into grpc metadata.
+func (s *Server) debugMetadata(r *http.Request) metadata.MD {
+	if !s.cfg.DebugTrace.Enabled {
+		return nil
+	}
+
+	md := metadata.MD{}
+	if v := r.Header.Get(s.cfg.DebugTrace.Header); v != "" {
+		md.Set(s.cfg.DebugTrace.Header, v)
+	}
+	return md
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+
+	"github.com/humans-net/grpc-core/discovery/consul"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type electionMetrics struct {
+	leader  *prometheus.GaugeVec
+	elected *prometheus.CounterVec
+}
+
+func newElectionMetrics(reg prometheus.Registerer) *electionMetrics {
+	m := &electionMetrics{
+		leader: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "consul_election_leader",
+			Help: "Leadership of the instance, 1 if it holds the lock and 0 otherwise.",
+		}, []string{"key"}),
+		elected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "consul_election_elected_total",
+			Help: "Total number of times the instance was elected leader.",
+		}, []string{"key"}),
+	}
+	reg.MustRegister(m.leader, m.elected)
+
+	return m
+}
+
+// Elect creates leader election among instances of the service, campaign runs while the server serves.
+// The lock is released on shutdown before Serve returns. Consul errors of the campaign are reported by
+// readiness info check election:<key> and leadership by consul_election_leader metric.
+// Elections use consul with any registry, it panics if Consul key isn't configured.
+func (s *Server) Elect(cfg consul.ElectionConfig, callbacks consul.ElectionCallbacks) *consul.Election {
+	var key string
+	onElected, onLost := callbacks.OnElected, callbacks.OnLost
+	callbacks.OnElected = func(ctx context.Context) {
+		s.electionMetrics.leader.WithLabelValues(key).Set(1)
+		s.electionMetrics.elected.WithLabelValues(key).Inc()
+		if onElected != nil {
+			onElected(ctx)
+		}
+	}
+	callbacks.OnLost = func() {
+		s.electionMetrics.leader.WithLabelValues(key).Set(0)
+		if onLost != nil {
+			onLost()
+		}
+	}
+
+	e, err := consul.NewElection(s.electionConsulConfig(), cfg, callbacks)
+	if err != nil {
+		s.log.Sugar().Panicf("failed to create leader election: %v", err)
+	}
+	key = e.Key()
+	s.electionMetrics.leader.WithLabelValues(key).Set(0)
+	s.checks.AddReadinessInfo("election:"+key, e)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.elections = append(s.elections, e)
+	if s.campaigning {
+		go e.Run(s.ctx)
+	}
+
+	return e
+}
+
+// electionConsulConfig returns Consul config of elections, Consul key is loaded here unless registry is consul,
+// as elections use consul regardless of registry. It panics if Consul key isn't configured.
+func (s *Server) electionConsulConfig() consul.Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.consulCfg.Name == "" {
+		if err := s.loader.Load("Consul", &s.consulCfg); err != nil {
+			s.log.Sugar().Panicf("leader election requires Consul key with registry other than consul: %v", err)
+		}
+		if s.consulCfg.Endpoint == "" {
+			s.log.Sugar().Panicf("leader election requires Consul.Endpoint with registry other than consul")
+		}
+		s.consulCfg.Name = s.cfg.Name
+	}
+	return s.consulCfg
+}
+
+// runElections starts campaigns of elections created before Serve.
+func (s *Server) runElections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.campaigning = true
+	for _, e := range s.elections {
+		go e.Run(s.ctx)
+	}
+}
+
+// waitElections waits for release of locks held by elections.
+func (s *Server) waitElections() {
+	s.lock.Lock()
+	elections := s.elections
+	s.lock.Unlock()
+
+	for _, e := range elections {
+		e.Wait()
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/humans-net/grpc-core/tracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+// MethodBuckets overrides latency histogram buckets of single grpc method.
+type MethodBuckets struct {
+	// Method is full grpc method name, e.g. /package.Service/Method.
+	Method string `validate:"nonzero"`
+	// Buckets are latency buckets in seconds.
+	Buckets []float64 `validate:"nonzero"`
+}
+
+// latencyHistogram is grpc handling time histogram compatible with grpc_prometheus one.
+// It allows buckets to be overridden per method and attaches trace id of sampled requests as exemplar.
+type latencyHistogram struct {
+	opts      prometheus.HistogramOpts
+	overrides map[string][]float64
+
+	lock       sync.RWMutex
+	histograms map[string]prometheus.Histogram
+}
+
+func newLatencyHistogram(name, help string, buckets []float64, overrides []MethodBuckets) *latencyHistogram {
+	h := &latencyHistogram{
+		opts: prometheus.HistogramOpts{
+			Name:    name,
+			Help:    help,
+			Buckets: buckets,
+		},
+		overrides:  make(map[string][]float64, len(overrides)),
+		histograms: map[string]prometheus.Histogram{},
+	}
+	for _, o := range overrides {
+		h.overrides[o.Method] = o.Buckets
+	}
+
+	return h
+}
+
+// Describe implements prometheus.Collector. Histogram is unchecked collector as buckets may differ per method.
+func (h *latencyHistogram) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (h *latencyHistogram) Collect(ch chan<- prometheus.Metric) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for _, m := range h.histograms {
+		m.Collect(ch)
+	}
+}
+
+func (h *latencyHistogram) observe(ctx context.Context, fullMethod string, d time.Duration) {
+	m := h.histogram(fullMethod)
+	if traceID, ok := tracer.SampledTraceID(ctx); ok {
+		if eo, ok := m.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(d.Seconds(), prometheus.Labels{"trace_id": traceID})
+			return
+		}
+	}
+	m.Observe(d.Seconds())
+}
+
+func (h *latencyHistogram) histogram(fullMethod string) prometheus.Histogram {
+	h.lock.RLock()
+	m, ok := h.histograms[fullMethod]
+	h.lock.RUnlock()
+	if ok {
+		return m
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if m, ok := h.histograms[fullMethod]; ok {
+		return m
+	}
+
+	service, method := splitMethodName(fullMethod)
+	opts := h.opts
+	opts.ConstLabels = prometheus.Labels{"grpc_type": "unary", "grpc_service": service, "grpc_method": method}
+	if buckets, ok := h.overrides[fullMethod]; ok {
+		opts.Buckets = buckets
+	}
+	m = prometheus.NewHistogram(opts)
+	h.histograms[fullMethod] = m
+
+	return m
+}
+
+func (h *latencyHistogram) unaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	h.observe(ctx, info.FullMethod, time.Since(start))
+	return resp, err
+}
+
+func (h *latencyHistogram) unaryClientInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	h.observe(ctx, method, time.Since(start))
+	return err
+}
+
+func splitMethodName(fullMethodName string) (string, string) {
+	fullMethodName = strings.TrimPrefix(fullMethodName, "/")
+	if i := strings.Index(fullMethodName, "/"); i >= 0 {
+		return fullMethodName[:i], fullMethodName[i+1:]
+	}
+	return "unknown", "unknown"
+}
@@ -2,44 +2,172 @@ package server
 
 import (
 	"context"
-	
+	"sync"
+
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
-//health
+const healthCheckMethod = "/grpc.health.v1.Health/Check"
+
+// HealthCheck implements grpc health service tracking serving status per service name.
+// Empty service name stands for the health of the whole server.
 type HealthCheck struct {
-	watchServer grpc_health_v1.Health_WatchServer
+	lock     sync.Mutex
+	statuses map[string]grpc_health_v1.HealthCheckResponse_ServingStatus
+	watchers map[string]map[chan grpc_health_v1.HealthCheckResponse_ServingStatus]struct{}
+	// setByApp holds services which status was set by SetServingStatus, readiness doesn't change them
+	setByApp map[string]bool
+	// stopping is set when server is shutting down, statuses can't be changed anymore
+	stopping bool
+	// done is closed on shutdown to end watch streams, so they don't block graceful stop
+	done chan struct{}
 }
 
-var healthCheckResponse = &grpc_health_v1.HealthCheckResponse{
-	Status: grpc_health_v1.HealthCheckResponse_SERVING,
+// NewHealthCheck creates HealthCheck with the whole server SERVING.
+func NewHealthCheck() *HealthCheck {
+	return &HealthCheck{
+		statuses: map[string]grpc_health_v1.HealthCheckResponse_ServingStatus{
+			"": grpc_health_v1.HealthCheckResponse_SERVING,
+		},
+		watchers: map[string]map[chan grpc_health_v1.HealthCheckResponse_ServingStatus]struct{}{},
+		setByApp: map[string]bool{},
+		done:     make(chan struct{}),
+	}
 }
 
-// Check implements the health check interface, which directly returns to health status. There are also more complex health check strategies, such as returning based on server load.
+// Check implements grpc_health_v1.HealthServer. It returns NotFound for services which status was never set.
 func (h *HealthCheck) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
-	l := ctxzap.Extract(ctx)
-	l.Info("received health check")
-	return healthCheckResponse, nil
+	ctxzap.Extract(ctx).Debug("received health check")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if st, ok := h.statuses[req.Service]; ok {
+		return &grpc_health_v1.HealthCheckResponse{Status: st}, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "unknown service %q", req.Service)
 }
 
+// Watch implements grpc_health_v1.HealthServer. It streams every status change of the service
+// until client disconnects or server shuts down.
 func (h *HealthCheck) Watch(req *grpc_health_v1.HealthCheckRequest, w grpc_health_v1.Health_WatchServer) error {
-	grpclog.Infof("received health check from watching service %+v", req)
-	if err := w.Send(healthCheckResponse); err != nil {
-		grpclog.Errorf("failed to send health check watch respose: %v", err)
-		return err
+	updates := make(chan grpc_health_v1.HealthCheckResponse_ServingStatus, 1)
+
+	h.lock.Lock()
+	st, ok := h.statuses[req.Service]
+	if !ok {
+		st = grpc_health_v1.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	updates <- st
+	if h.watchers[req.Service] == nil {
+		h.watchers[req.Service] = map[chan grpc_health_v1.HealthCheckResponse_ServingStatus]struct{}{}
+	}
+	h.watchers[req.Service][updates] = struct{}{}
+	h.lock.Unlock()
+
+	defer func() {
+		h.lock.Lock()
+		delete(h.watchers[req.Service], updates)
+		h.lock.Unlock()
+	}()
+
+	var last grpc_health_v1.HealthCheckResponse_ServingStatus = -1
+	send := func(st grpc_health_v1.HealthCheckResponse_ServingStatus) error {
+		if st == last {
+			return nil
+		}
+		last = st
+		if err := w.Send(&grpc_health_v1.HealthCheckResponse{Status: st}); err != nil {
+			grpclog.Errorf("failed to send health check watch response: %v", err)
+			return err
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case st := <-updates:
+			if err := send(st); err != nil {
+				return err
+			}
+		case <-h.done:
+			// NOT_SERVING is already in updates, deliver it before closing the stream
+			select {
+			case st := <-updates:
+				return send(st)
+			default:
+				return nil
+			}
+		case <-w.Context().Done():
+			return status.Error(codes.Canceled, "health check watch stream has ended")
+		}
 	}
-	return nil
 }
 
+// SetServingStatus sets status of the service and notifies its watchers.
+// Once set, status of the service is owned by the caller and isn't driven by readiness checks anymore,
+// including the whole server ("") and service name of the server.
+// It is no-op once server is shutting down.
+func (h *HealthCheck) SetServingStatus(service string, st grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.stopping {
+		grpclog.Infof("health status of %q isn't changed to %v, server is shutting down", service, st)
+		return
+	}
+	h.setByApp[service] = true
+	h.setServingStatusLocked(service, st)
+}
+
+// setReadiness sets status of the service unless it was set by SetServingStatus.
+func (h *HealthCheck) setReadiness(service string, st grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.stopping || h.setByApp[service] {
+		return
+	}
+	h.setServingStatusLocked(service, st)
+}
+
+func (h *HealthCheck) setServingStatusLocked(service string, st grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	h.statuses[service] = st
+	for updates := range h.watchers[service] {
+		// drop stale status that wasn't sent yet, only the latest one matters
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- st
+	}
+}
+
+// registerService sets service SERVING unless its status was set already.
+func (h *HealthCheck) registerService(service string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.statuses[service]; !ok && !h.stopping {
+		h.setServingStatusLocked(service, grpc_health_v1.HealthCheckResponse_SERVING)
+	}
+}
+
+// shutdown sets all services NOT_SERVING and notifies watchers, further status changes are ignored.
 func (h *HealthCheck) shutdown() {
-	if h.watchServer == nil {
-		grpclog.Errorf("watch server wasn't init")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.stopping {
 		return
 	}
-	if err := h.watchServer.Send(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.
-		HealthCheckResponse_NOT_SERVING}); err != nil {
-		grpclog.Errorf("failed to send NOT_SERVING to Health Check Watcher")
+	h.stopping = true
+	for service := range h.statuses {
+		h.setServingStatusLocked(service, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
 	}
+	close(h.done)
 }
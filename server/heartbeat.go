@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/humans-net/grpc-core/discovery/consul"
+	"github.com/humans-net/grpc-core/health"
+)
+
+// heartbeat reports readiness of the server to consul TTL checks of reg until ctx is done,
+// then instance is deregistered by Serve.
+func (s *Server) heartbeat(ctx context.Context, reg *consul.Registration) {
+	ticker := time.NewTicker(reg.TTL() / 3)
+	defer ticker.Stop()
+
+	for {
+		s.updateTTL(reg, s.checks.Ready(ctx))
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateTTL reports critical status if server isn't ready and passing otherwise.
+// Failing non-critical checks are reported by output only, as consul resolvers drop instances which aren't passing.
+func (s *Server) updateTTL(reg *consul.Registration, report health.Report) {
+	status := api.HealthPassing
+	if !report.Healthy {
+		status = api.HealthCritical
+	}
+
+	output, err := json.Marshal(report)
+	if err != nil {
+		s.log.Sugar().Errorf("failed to marshal readiness report: %v", err)
+	}
+	if err := reg.UpdateTTL(status, string(output)); err != nil {
+		s.log.Sugar().Errorf("failed to report %s status to consul: %v", status, err)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/humans-net/grpc-core/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+// unmatchedRoute labels gateway requests that were not routed to any grpc method.
+const unmatchedRoute = "unmatched"
+
+// httpMetrics holds RED metrics of http requests served by Server.ServeHTTP.
+// Gateway requests are labeled by http pattern of grpc method they are routed to, custom handlers by their
+// registered path, so label cardinality does not depend on request paths.
+type httpMetrics struct {
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	requestSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	inFlight     *prometheus.GaugeVec
+	// routes are set once services are registered, before the server serves
+	routes httpRoutes
+}
+
+func newHTTPMetrics(reg *metrics.Registry, buckets []float64) *httpMetrics {
+	sizeBuckets := prometheus.ExponentialBuckets(100, 10, 6)
+	m := &httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_server_handled_total",
+			Help: "Total number of http requests completed on the server.",
+		}, []string{"route", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_server_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of http requests handled by the server.",
+			Buckets: buckets,
+		}, []string{"route", "method", "code"}),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_server_request_size_bytes",
+			Help:    "Histogram of body size of http requests received by the server.",
+			Buckets: sizeBuckets,
+		}, []string{"route", "method"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_server_response_size_bytes",
+			Help:    "Histogram of body size of http responses sent by the server.",
+			Buckets: sizeBuckets,
+		}, []string{"route", "method", "code"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "http_server_in_flight_requests",
+			Help: "Number of http requests currently handled by the server.",
+		}, []string{"route"}),
+	}
+	// names aren't namespaced, like grpc metrics of the server
+	reg.MustRegister(m.requests, m.duration, m.requestSize, m.responseSize, m.inFlight)
+
+	return m
+}
+
+// instrument measures requests of custom handler registered for path.
+func (m *httpMetrics) instrument(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlight := m.inFlight.WithLabelValues(path)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		m.serve(w, r, func(w http.ResponseWriter, r *http.Request) string {
+			h(w, r)
+			return path
+		})
+	}
+}
+
+// instrumentGateway measures requests of grpc gateway, route is http pattern of grpc method of the loopback call.
+// Request is in flight once it is routed to grpc method.
+func (m *httpMetrics) instrumentGateway(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.serve(w, r, func(w http.ResponseWriter, r *http.Request) string {
+			holder := &routeHolder{metrics: m, httpMethod: r.Method, route: unmatchedRoute}
+			defer holder.done()
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, holder)))
+			return holder.route
+		})
+	}
+}
+
+func (m *httpMetrics) serve(w http.ResponseWriter, r *http.Request, serve func(w http.ResponseWriter, r *http.Request) string) {
+	start := time.Now()
+	body := &countingReader{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	route := serve(rec, r)
+
+	code := strconv.Itoa(rec.status)
+	m.requests.WithLabelValues(route, r.Method, code).Inc()
+	m.duration.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+	m.requestSize.WithLabelValues(route, r.Method).Observe(float64(body.size))
+	m.responseSize.WithLabelValues(route, r.Method, code).Observe(float64(rec.size))
+}
+
+type routeKey struct{}
+
+// routeHolder receives grpc method called by the gateway for the http request.
+type routeHolder struct {
+	metrics    *httpMetrics
+	httpMethod string
+	route      string
+	inFlight   prometheus.Gauge
+}
+
+// set sets route of grpc method called by the gateway, the first call only counts, as gateway calls one method.
+func (h *routeHolder) set(grpcMethod string) {
+	if h.inFlight != nil {
+		return
+	}
+	h.route = h.metrics.routes.route(grpcMethod, h.httpMethod)
+	h.inFlight = h.metrics.inFlight.WithLabelValues(h.route)
+	h.inFlight.Inc()
+}
+
+func (h *routeHolder) done() {
+	if h.inFlight != nil {
+		h.inFlight.Dec()
+	}
+}
+
+// gatewayRouteInterceptor is client interceptor of gateway loopback connection reporting called method as http route.
+func gatewayRouteInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if h, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		h.set(method)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// gatewayRouteStreamInterceptor is stream counterpart of gatewayRouteInterceptor.
+func gatewayRouteStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if h, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		h.set(method)
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// countingReader counts bytes read from request body.
+type countingReader struct {
+	io.ReadCloser
+	size int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.size += n
+	return n, err
+}
+
+// statusRecorder remembers status code and size of the body written to http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Flush implements http.Flusher for streaming gateway responses.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
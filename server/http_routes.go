@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/pkg/errors"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/grpclog"
+)
+
+// httpRoutes maps grpc methods to http patterns of their google.api.http bindings.
+type httpRoutes map[string][]httpRoute
+
+type httpRoute struct {
+	method  string
+	pattern string
+}
+
+// newHTTPRoutes reads http bindings from proto descriptors of services registered on grpc server.
+func newHTTPRoutes(services map[string]grpc.ServiceInfo) httpRoutes {
+	routes := httpRoutes{}
+	files := map[string]bool{}
+	for _, info := range services {
+		file, ok := info.Metadata.(string)
+		if !ok || files[file] {
+			continue
+		}
+		files[file] = true
+
+		fd, err := fileDescriptor(file)
+		if err != nil {
+			grpclog.Warningf("http routes of %s are unknown, gateway requests are labeled by grpc method: %v", file, err)
+			continue
+		}
+		for _, service := range fd.GetService() {
+			for _, method := range service.GetMethod() {
+				if method.GetOptions() == nil {
+					continue
+				}
+				ext, err := proto.GetExtension(method.GetOptions(), annotations.E_Http)
+				if err != nil {
+					continue
+				}
+				rule, ok := ext.(*annotations.HttpRule)
+				if !ok {
+					continue
+				}
+				fullMethod := "/" + fd.GetPackage() + "." + service.GetName() + "/" + method.GetName()
+				if fd.GetPackage() == "" {
+					fullMethod = "/" + service.GetName() + "/" + method.GetName()
+				}
+				routes[fullMethod] = append(routes[fullMethod], bindings(rule)...)
+			}
+		}
+	}
+
+	return routes
+}
+
+func fileDescriptor(file string) (*descriptor.FileDescriptorProto, error) {
+	gz := proto.FileDescriptor(file)
+	if gz == nil {
+		return nil, errors.Errorf("descriptor of %s isn't registered", file)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &descriptor.FileDescriptorProto{}
+	if err := proto.Unmarshal(b, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// bindings returns routes of http rule and its additional bindings.
+func bindings(rule *annotations.HttpRule) []httpRoute {
+	var routes []httpRoute
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		routes = append(routes, httpRoute{method: "GET", pattern: p.Get})
+	case *annotations.HttpRule_Put:
+		routes = append(routes, httpRoute{method: "PUT", pattern: p.Put})
+	case *annotations.HttpRule_Post:
+		routes = append(routes, httpRoute{method: "POST", pattern: p.Post})
+	case *annotations.HttpRule_Delete:
+		routes = append(routes, httpRoute{method: "DELETE", pattern: p.Delete})
+	case *annotations.HttpRule_Patch:
+		routes = append(routes, httpRoute{method: "PATCH", pattern: p.Patch})
+	case *annotations.HttpRule_Custom:
+		routes = append(routes, httpRoute{method: p.Custom.GetKind(), pattern: p.Custom.GetPath()})
+	}
+	for _, additional := range rule.GetAdditionalBindings() {
+		routes = append(routes, bindings(additional)...)
+	}
+	return routes
+}
+
+// route returns http pattern of grpc method bound to http method, grpc method itself if it has no such binding.
+// The first binding is used if method has several bindings of http method.
+func (r httpRoutes) route(grpcMethod, httpMethod string) string {
+	for _, route := range r[grpcMethod] {
+		if route.method == httpMethod {
+			return route.pattern
+		}
+	}
+	return grpcMethod
+}
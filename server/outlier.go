@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/humans-net/grpc-core/discovery/lb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type outlierMetrics struct {
+	ejections *prometheus.CounterVec
+	ejected   *prometheus.GaugeVec
+}
+
+func newOutlierMetrics(reg prometheus.Registerer) *outlierMetrics {
+	m := &outlierMetrics{
+		ejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_client_outlier_ejections_total",
+			Help: "Total number of instances ejected from balancing by outlier detection.",
+		}, []string{"target"}),
+		ejected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "grpc_client_outlier_ejected",
+			Help: "Number of instances currently ejected from balancing by outlier detection.",
+		}, []string{"target"}),
+	}
+	reg.MustRegister(m.ejections, m.ejected)
+
+	return m
+}
+
+// onEjection logs and counts ejections of instances of connection named connName.
+func (s *Server) onEjection(connName string) func(e lb.Ejection) {
+	return func(e lb.Ejection) {
+		if !e.Ejected {
+			s.outlierMetrics.ejected.WithLabelValues(connName).Dec()
+			s.log.Sugar().Infof("instance %s of %s returned to balancing after ejection", e.Addr, connName)
+			return
+		}
+
+		s.outlierMetrics.ejections.WithLabelValues(connName).Inc()
+		s.outlierMetrics.ejected.WithLabelValues(connName).Inc()
+		s.log.Sugar().Warnf("instance %s of %s ejected for %s, failure rate %.2f, mean latency %s",
+			e.Addr, connName, e.Duration, e.FailureRate, e.MeanLatency)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/humans-net/grpc-core/discovery"
+	"github.com/humans-net/grpc-core/discovery/consul"
+	"github.com/humans-net/grpc-core/discovery/dir"
+	"github.com/humans-net/grpc-core/discovery/static"
+	"google.golang.org/grpc/resolver"
+)
+
+// Registries of the server.
+const (
+	RegistryConsul = "consul"
+	RegistryDir    = "dir"
+	RegistryNone   = "none"
+)
+
+// initRegistry creates registry of cfg and registers its resolver, clients use its scheme by default.
+func (s *Server) initRegistry(cfg DiscoveryConfig) {
+	switch cfg.Registry {
+	case RegistryConsul:
+		s.loader.MustLoad("Consul", &s.consulCfg)
+		s.consulCfg.Name = s.cfg.Name
+		var opts []consul.BuilderOption
+		if s.consulCfg.CacheDir != "" {
+			opts = append(opts, consul.WithCacheDir(s.consulCfg.CacheDir))
+		}
+		registry, err := consul.NewRegistry(s.consulCfg, opts...)
+		if err != nil {
+			s.log.Sugar().Panicf("failed to create consul registry: %v", err)
+		}
+		resolver.Register(registry.ResolverBuilder())
+		s.registry, s.registryScheme = registry, consul.Scheme
+		s.instanceMeta = s.consulCfg.Meta
+	case RegistryDir:
+		if cfg.Dir == "" {
+			s.log.Sugar().Panicf("Discovery.Dir of %s registry is not configured", RegistryDir)
+		}
+		registry := dir.NewRegistry(cfg.Dir)
+		resolver.Register(registry.ResolverBuilder())
+		s.registry, s.registryScheme = registry, dir.Scheme
+		s.instanceMeta = cfg.Meta
+	case RegistryNone:
+		s.registry, s.registryScheme = discovery.NewNoopRegistry(), static.Scheme
+		s.instanceMeta = cfg.Meta
+	default:
+		s.log.Sugar().Panicf("unknown registry %q", cfg.Registry)
+	}
+}
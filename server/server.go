@@ -8,29 +8,33 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
-	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
-	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/humans-net/grpc-core/config"
+	"github.com/humans-net/grpc-core/discovery"
 	"github.com/humans-net/grpc-core/discovery/consul"
+	"github.com/humans-net/grpc-core/discovery/dns"
+	"github.com/humans-net/grpc-core/discovery/file"
+	"github.com/humans-net/grpc-core/discovery/lb"
+	"github.com/humans-net/grpc-core/discovery/static"
+	"github.com/humans-net/grpc-core/health"
 	"github.com/humans-net/grpc-core/logger"
+	"github.com/humans-net/grpc-core/metrics"
 	"github.com/humans-net/grpc-core/tracer"
-	"github.com/opentracing/opentracing-go"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/soheilhy/cmux"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/net/netutil"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/balancer/roundrobin"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
@@ -41,14 +45,51 @@ type Registerer interface {
 }
 
 type Server struct {
-	services     []Registerer
-	cfg          Config
-	consulCfg    consul.Config
+	services  []Registerer
+	cfg       Config
+	consulCfg consul.Config
+	// registry keeps instance of the server, registryScheme resolves its instances
+	registry       discovery.Registry
+	registryScheme string
+	instanceMeta   map[string]string
+	// servicesFile is file listed services are resolved from by file resolver, the resolver isn't registered if empty
+	servicesFile string
+	// connect provides consul connect certificates until stopConnect, it is nil unless Consul.Connect is set
+	connect       *consul.Connect
+	stopConnect   context.CancelFunc
+	spanCfg       tracer.SpanConfig
+	metrics       *metrics.Registry
+	serverMetrics *grpc_prometheus.ServerMetrics
+	serverLatency *latencyHistogram
+	clientMetrics *grpc_prometheus.ClientMetrics
+	clientLatency *latencyHistogram
+	httpMetrics   *httpMetrics
+	// pusher pushes metrics to Pushgateway until stopPush, it is nil unless push is enabled
+	pusher       *metrics.Pusher
+	stopPush     context.CancelFunc
 	grpcProxyMux *runtime.ServeMux
-	exitFunc     func(code int)
-	ctx          context.Context
-	log          *zap.Logger
-	httpHandlers map[string]http.HandlerFunc
+	// gatewayHandler serves grpcProxyMux within a span of the http request
+	gatewayHandler  http.HandlerFunc
+	exitFunc        func(code int)
+	ctx             context.Context
+	log             *zap.Logger
+	httpHandlers    map[string]http.HandlerFunc
+	health          *HealthCheck
+	checks          *health.Registry
+	loader          config.Loader
+	connStates      *prometheus.GaugeVec
+	breakerMetrics  *breakerMetrics
+	routeCounter    *prometheus.CounterVec
+	outlierMetrics  *outlierMetrics
+	electionMetrics *electionMetrics
+
+	// lock guards exitFunc, conns, elections, campaigning and consulCfg loaded by Elect
+	lock sync.Mutex
+	// conns counts connections per microservice
+	conns map[string]int
+	// elections are leader elections created by Elect, campaigning is set once they run
+	elections   []*consul.Election
+	campaigning bool
 }
 
 func New(loader config.Loader, services ...Registerer) *Server {
@@ -56,15 +97,57 @@ func New(loader config.Loader, services ...Registerer) *Server {
 		services:     services,
 		log:          logger.Init(loader),
 		httpHandlers: map[string]http.HandlerFunc{},
+		health:       NewHealthCheck(),
+		loader:       loader,
+		conns:        map[string]int{},
 	}
 
 	grpc_zap.ReplaceGrpcLogger(s.log)
 
 	loader.MustLoad("Server", &s.cfg)
 	s.cfg.withDefaults()
-	loader.MustLoad("Consul", &s.consulCfg)
-	s.consulCfg.Name = s.cfg.Name
-	consul.RegisterResolver()
+	discoveryCfg := DiscoveryConfig{}
+	if err := loader.Load("Discovery", &discoveryCfg); err != nil {
+		s.log.Sugar().Infof("Discovery not configured, using defaults: %v", err)
+	}
+	discoveryCfg.withDefaults()
+	s.initRegistry(discoveryCfg)
+	static.RegisterResolver()
+	dns.RegisterResolver(discoveryCfg.DNSRefresh)
+	if discoveryCfg.File != "" {
+		file.RegisterResolver(discoveryCfg.File)
+		s.servicesFile = discoveryCfg.File
+	}
+	lb.Register(s.instanceMeta[discovery.MetaZone])
+
+	healthCfg := health.Config{}
+	if err := loader.Load("Health", &healthCfg); err != nil {
+		s.log.Sugar().Infof("Health not configured, using defaults: %v", err)
+	}
+	s.checks = health.New(healthCfg)
+	s.initConnect()
+
+	metricsCfg := metrics.Config{}
+	if err := loader.Load("Metrics", &metricsCfg); err != nil {
+		s.log.Sugar().Infof("Metrics not configured, using defaults: %v", err)
+	}
+	s.metrics = metrics.New(s.cfg.Name, metricsCfg)
+	// handling time histograms of grpc_prometheus are replaced by latencyHistogram
+	s.serverMetrics = grpc_prometheus.NewServerMetrics()
+	s.serverLatency = newLatencyHistogram("grpc_server_handling_seconds",
+		"Histogram of response latency (seconds) of gRPC that had been application-level handled by the server.",
+		s.cfg.HistogramBuckets, s.cfg.MethodHistogramBuckets)
+	s.clientMetrics = grpc_prometheus.NewClientMetrics()
+	s.clientLatency = newLatencyHistogram("grpc_client_handling_seconds",
+		"Histogram of response latency (seconds) of the gRPC until it is finished by the application.",
+		s.cfg.ClientHistogramBuckets, s.cfg.ClientMethodHistogramBuckets)
+	s.metrics.MustRegister(s.serverMetrics, s.serverLatency, s.clientMetrics, s.clientLatency)
+	s.httpMetrics = newHTTPMetrics(s.metrics, s.cfg.HistogramBuckets)
+	s.connStates = newConnStateGauge(s.metrics.Registerer())
+	s.breakerMetrics = newBreakerMetrics(s.metrics.Registerer())
+	s.routeCounter = newRouteCounter(s.metrics.Registerer())
+	s.outlierMetrics = newOutlierMetrics(s.metrics.Registerer())
+	s.electionMetrics = newElectionMetrics(s.metrics.Registerer())
 
 	s.AddExitFunc(func(_ int) {
 		if err := s.log.Sync(); err != nil {
@@ -72,7 +155,15 @@ func New(loader config.Loader, services ...Registerer) *Server {
 		}
 	})
 
-	tracerCloser, err := tracer.InitJaeger(s.cfg.Name, loader, s.log)
+	if metricsCfg.Push.Enabled {
+		s.startMetricsPush(metricsCfg.Push)
+	}
+
+	if err := loader.Load("TracerSpan", &s.spanCfg); err != nil {
+		s.log.Sugar().Infof("TracerSpan not configured, copying no tags to spans: %v", err)
+	}
+
+	tracerCloser, err := tracer.InitJaeger(s.cfg.Name, loader, s.log, s.metrics.Registerer())
 	if err != nil {
 		s.log.Sugar().Errorf("failed to proper init jaeger tracing %v", err)
 	}
@@ -87,31 +178,12 @@ func New(loader config.Loader, services ...Registerer) *Server {
 	return s
 }
 
-func (s *Server) Connect(msName string) *grpc.ClientConn {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-
-	connOpts := []grpc.DialOption{
-		grpc.WithBlock(),
-		grpc.WithInsecure(),
-		grpc.WithBalancerName(roundrobin.Name),
-		grpc.WithChainUnaryInterceptor(
-			grpc_zap.UnaryClientInterceptor(s.log, []grpc_zap.Option{grpc_zap.WithLevels(codeToLevel)}...),
-			grpc_zap.PayloadUnaryClientInterceptor(s.log, s.clientPayloadLoggingDecider),
-			grpc_prometheus.UnaryClientInterceptor,
-			grpc_opentracing.UnaryClientInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer())),
-		),
-	}
-
-	target := fmt.Sprintf("consul://%s/%s", s.consulCfg.Endpoint, msName)
-	clientConn, err := grpc.DialContext(ctx, target, connOpts...)
+// Connect connects to microservice msName and panics on failure, see ConnectContext.
+func (s *Server) Connect(msName string, opts ...ClientOption) *grpc.ClientConn {
+	clientConn, err := s.ConnectContext(context.Background(), msName, opts...)
 	if err != nil {
-		panic(fmt.Sprintf("failed to connect to %s: %v", target, err))
+		panic(err.Error())
 	}
-	s.AddExitFunc(func(_ int) {
-		if err := clientConn.Close(); err != nil {
-			grpclog.Errorf("failed to close client conn to %s: %v", msName, err)
-		}
-	})
 	return clientConn
 }
 
@@ -127,34 +199,60 @@ func (s *Server) Serve(ctx context.Context) {
 	// limit concurrent requests, 10k for now
 	l = netutil.LimitListener(l, 10000)
 
+	// grpc accepts connect mutual TLS only, if it is enabled, http stays plain for checks and metrics
+	grpcMatcher := cmux.HTTP2()
+	var serverOpts []grpc.ServerOption
+	gatewayCreds := grpc.WithInsecure()
+	if s.connect != nil {
+		grpcMatcher = cmux.TLS()
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(s.connect.ServerTLSConfig())))
+		gatewayCreds = grpc.WithTransportCredentials(credentials.NewTLS(s.connect.ClientTLSConfig(s.cfg.Name)))
+	}
+
 	connMultiplexer := cmux.New(l)
-	grpcL := connMultiplexer.Match(cmux.HTTP2())
+	grpcL := connMultiplexer.Match(grpcMatcher)
 	httpL := connMultiplexer.Match(cmux.HTTP1Fast())
 
 	// grpc
-	grpcS := grpc.NewServer(
+	grpcS := grpc.NewServer(append(serverOpts,
 		grpc_middleware.WithUnaryServerChain(
 			grpc_ctxtags.UnaryServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
-			grpc_zap.UnaryServerInterceptor(s.log, []grpc_zap.Option{grpc_zap.WithLevels(codeToLevel)}...),
+			tracer.UnaryServerInterceptor(s.spanCfg),
+			deadlineUnaryServerInterceptor,
+			s.debugUnaryServerInterceptor,
+			grpc_zap.UnaryServerInterceptor(s.log, []grpc_zap.Option{grpc_zap.WithLevels(codeToLevel), grpc_zap.WithDecider(logDecider)}...),
 			grpc_zap.PayloadUnaryServerInterceptor(s.log, s.serverPayloadLoggingDecider),
-			grpc_opentracing.UnaryServerInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer())),
-			grpc_prometheus.UnaryServerInterceptor,
+			s.serverMetrics.UnaryServerInterceptor(),
+			s.serverLatency.unaryServerInterceptor,
 		),
-	)
-
-	grpc_prometheus.EnableHandlingTimeHistogram()
-	grpc_prometheus.EnableClientHandlingTimeHistogram()
-	s.HandleHTTP("/metrics", promhttp.Handler().ServeHTTP)
-
-	s.grpcProxyMux = runtime.NewServeMux()
+	)...)
+
+	s.HandleHTTP("/metrics", s.metrics.Handler().ServeHTTP)
+	s.HandleHTTP("/healthz", s.checks.LiveHandler)
+	s.HandleHTTP("/readyz", s.checks.ReadyHandler)
+
+	s.grpcProxyMux = runtime.NewServeMux(runtime.WithMetadata(s.gatewayMetadata))
+	s.gatewayHandler = s.httpMetrics.instrumentGateway(traceGateway(s.grpcProxyMux))
+	gatewayDialOpts := []grpc.DialOption{
+		gatewayCreds,
+		grpc.WithUnaryInterceptor(gatewayRouteInterceptor),
+		grpc.WithStreamInterceptor(gatewayRouteStreamInterceptor),
+	}
 	for _, se := range s.services {
 		se.GRPCRegisterer()(grpcS)
-		if err := se.HTTPRegisterer()(s.ctx, s.grpcProxyMux, s.cfg.Endpoint, []grpc.DialOption{grpc.WithInsecure()}); err != nil {
+		if err := se.HTTPRegisterer()(s.ctx, s.grpcProxyMux, s.cfg.Endpoint, gatewayDialOpts); err != nil {
 			s.log.Sugar().Panicf("failed to register http handler for service %T: %v", s, err)
 		}
 	}
-	healthCheck := &HealthCheck{}
-	grpc_health_v1.RegisterHealthServer(grpcS, healthCheck)
+	s.serverMetrics.InitializeMetrics(grpcS)
+	s.httpMetrics.routes = newHTTPRoutes(grpcS.GetServiceInfo())
+	for name := range grpcS.GetServiceInfo() {
+		s.health.registerService(name)
+	}
+	// consul checks health of the service by its name
+	s.health.registerService(s.cfg.Name)
+	grpc_health_v1.RegisterHealthServer(grpcS, s.health)
+	go s.checks.Watch(s.ctx, s.reflectReadiness)
 
 	//TODO collect errors from goroutines
 	go func() {
@@ -177,19 +275,96 @@ func (s *Server) Serve(ctx context.Context) {
 		}
 	}()
 
-	consul.RegisterService(s.consulCfg)
+	instance := discovery.LocalInstance(s.cfg.Name, s.instanceMeta)
+	if err := s.registry.Register(s.ctx, instance); err != nil {
+		s.log.Sugar().Panicf("failed to register %s: %v", instance.ID, err)
+	}
+	if registry, ok := s.registry.(*consul.Registry); ok {
+		if reg := registry.Registration(); reg.TTL() > 0 {
+			go s.heartbeat(s.ctx, reg)
+		}
+	}
+	s.runElections()
 
 	<-s.ctx.Done()
-	healthCheck.shutdown()
+	// instance is removed from registry first, so clients stop calling it while it serves calls in flight
+	if err := s.registry.Deregister(context.Background(), instance); err != nil {
+		s.log.Sugar().Errorf("failed to deregister %s: %v", instance.ID, err)
+	}
+	s.health.shutdown()
 	grpcS.GracefulStop()
+	s.waitElections()
 	//TODO watchShutdown streams with httpS.RegisterOnShutdown()
 	if err := httpS.Shutdown(s.ctx); err != nil {
 		s.log.Sugar().Errorf("http server watchShutdown error %v", err)
 	}
+	s.pushFinalMetrics()
+	if s.stopConnect != nil {
+		// certificates are watched until calls in flight are served, loaded ones stay in use
+		s.stopConnect()
+	}
 
 	s.log.Sugar().Info("microservice gracefully stopped")
 }
 
+// startMetricsPush pushes metrics periodically, Serve pushes them once more on shutdown.
+func (s *Server) startMetricsPush(cfg metrics.PushConfig) {
+	pusher, err := s.metrics.NewPusher(s.cfg.Name, cfg)
+	if err != nil {
+		s.log.Sugar().Panicf("failed to create metrics pusher: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go pusher.Run(ctx)
+	s.pusher, s.stopPush = pusher, cancel
+}
+
+// PushMetrics stops periodic push and pushes metrics to Pushgateway right away, it does nothing if push isn't enabled.
+// Serve calls it on shutdown, batch jobs which never call Serve must call it once their work is done,
+// otherwise metrics recorded since the last periodic push are lost.
+func (s *Server) PushMetrics() error {
+	if s.pusher == nil {
+		return nil
+	}
+	s.stopPush()
+	return s.pusher.Push()
+}
+
+// pushFinalMetrics pushes metrics of calls served until shutdown.
+func (s *Server) pushFinalMetrics() {
+	if err := s.PushMetrics(); err != nil {
+		s.log.Sugar().Errorf("failed to push metrics on shutdown: %v", err)
+	}
+}
+
+// reflectReadiness reports readiness of the server as serving status of the whole server
+// and of the service name checked by consul, unless the app sets them by Health().SetServingStatus.
+func (s *Server) reflectReadiness(ready bool, report health.Report) {
+	st := grpc_health_v1.HealthCheckResponse_SERVING
+	if !ready {
+		st = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		s.log.Sugar().Warnf("server is not ready: %+v", report.Checks)
+	}
+
+	s.health.setReadiness("", st)
+	s.health.setReadiness(s.cfg.Name, st)
+}
+
+// Checks returns registry of readiness and liveness checks of the server.
+func (s *Server) Checks() *health.Registry {
+	return s.checks
+}
+
+// Health returns health service of the server, it is used to change serving status of services.
+func (s *Server) Health() *HealthCheck {
+	return s.health
+}
+
+// Metrics returns metrics registry of the server.
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics
+}
+
 func (s *Server) HandleHTTP(path string, h http.HandlerFunc) {
 	if _, ok := s.httpHandlers[path]; ok {
 		panic(fmt.Sprintf("http handler duplication for path %s", path))
@@ -199,14 +374,17 @@ func (s *Server) HandleHTTP(path string, h http.HandlerFunc) {
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h, ok := s.httpHandlers[r.URL.Path]; ok {
-		h(w, r)
+		s.httpMetrics.instrument(r.URL.Path, h)(w, r)
 		return
 	}
 
-	s.grpcProxyMux.ServeHTTP(w, r)
+	s.gatewayHandler(w, r)
 }
 
 func (s *Server) AddExitFunc(fn func(code int)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	exitFunc := s.exitFunc
 	if exitFunc == nil {
 		exitFunc = os.Exit
@@ -219,10 +397,14 @@ func (s *Server) AddExitFunc(fn func(code int)) {
 }
 
 func (s *Server) exit(code int) {
-	if s.exitFunc == nil {
+	s.lock.Lock()
+	exitFunc := s.exitFunc
+	s.lock.Unlock()
+
+	if exitFunc == nil {
 		os.Exit(code)
 	} else {
-		s.exitFunc(code)
+		exitFunc(code)
 	}
 }
 
@@ -234,6 +416,11 @@ func (s *Server) watchShutdown(cancelFunc context.CancelFunc) {
 	cancelFunc()
 }
 
+// logDecider suppresses logging of successful health checks.
+func logDecider(fullMethodName string, err error) bool {
+	return err != nil || fullMethodName != healthCheckMethod
+}
+
 func codeToLevel(code codes.Code) zapcore.Level {
 	switch code {
 	case codes.OK:
@@ -246,9 +433,9 @@ func codeToLevel(code codes.Code) zapcore.Level {
 }
 
 func (s *Server) serverPayloadLoggingDecider(ctx context.Context, fullMethodName string, servingObject interface{}) bool {
-	return *s.cfg.LogPayloads
+	return *s.cfg.LogPayloads || isDebug(ctx)
 }
 
 func (s *Server) clientPayloadLoggingDecider(ctx context.Context, fullMethodName string) bool {
-	return *s.cfg.LogPayloads
+	return *s.cfg.LogPayloads || isDebug(ctx)
 }
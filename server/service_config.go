@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// retryEnvVar must be "on" for grpc of this version to perform retries configured by service config.
+const retryEnvVar = "GRPC_GO_RETRY"
+
+const (
+	defaultRetryInitialBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff        = time.Second
+	defaultRetryBackoffMultiplier = 2
+	defaultHedgingDelay           = 100 * time.Millisecond
+)
+
+// MethodConfig configures calls to a service or its single method.
+type MethodConfig struct {
+	// Service is fully qualified grpc service name, e.g. "package.Service".
+	Service string `validate:"nonzero"`
+	// Method is method name, policy applies to all methods of Service if empty.
+	Method string
+	// Timeout is deadline of calls made without a shorter one.
+	Timeout time.Duration
+	// WaitForReady makes calls wait for connection instead of failing fast.
+	WaitForReady bool
+	// Retry is retry policy of calls, it can't be combined with Hedging.
+	Retry *RetryPolicy
+	// Hedging is hedging policy of unary calls, it can't be combined with Retry.
+	Hedging *HedgingPolicy
+}
+
+// RetryPolicy is grpc retry policy, see https://github.com/grpc/proposal/blob/master/A6-client-retries.md.
+type RetryPolicy struct {
+	// MaxAttempts is number of attempts including the original one, at least 2.
+	MaxAttempts int
+	// InitialBackoff is 100ms by default.
+	InitialBackoff time.Duration
+	// MaxBackoff is 1s by default.
+	MaxBackoff time.Duration
+	// BackoffMultiplier is 2 by default.
+	BackoffMultiplier float64
+	// RetryableStatusCodes are grpc code names like UNAVAILABLE, UNAVAILABLE only by default.
+	RetryableStatusCodes []string
+}
+
+// HedgingPolicy sends up to MaxAttempts copies of unary call, each one HedgingDelay after the previous one,
+// until any of them succeeds or fails with status code not listed in NonFatalStatusCodes.
+// grpc of this version doesn't support hedging, so it is done by client interceptor.
+type HedgingPolicy struct {
+	// MaxAttempts is number of attempts including the original one, at least 2.
+	MaxAttempts int
+	// HedgingDelay is 100ms by default, zero means all attempts are sent at once.
+	HedgingDelay *time.Duration
+	// NonFatalStatusCodes are grpc code names, which don't stop other attempts.
+	NonFatalStatusCodes []string
+}
+
+func (c *MethodConfig) withDefaults() {
+	if c.Retry != nil {
+		if c.Retry.InitialBackoff <= 0 {
+			c.Retry.InitialBackoff = defaultRetryInitialBackoff
+		}
+		if c.Retry.MaxBackoff <= 0 {
+			c.Retry.MaxBackoff = defaultRetryMaxBackoff
+		}
+		if c.Retry.BackoffMultiplier <= 0 {
+			c.Retry.BackoffMultiplier = defaultRetryBackoffMultiplier
+		}
+		if len(c.Retry.RetryableStatusCodes) == 0 {
+			c.Retry.RetryableStatusCodes = []string{"UNAVAILABLE"}
+		}
+	}
+	if c.Hedging != nil && c.Hedging.HedgingDelay == nil {
+		d := defaultHedgingDelay
+		c.Hedging.HedgingDelay = &d
+	}
+}
+
+// path returns full method name or prefix of service methods.
+func (c *MethodConfig) path() string {
+	return "/" + c.Service + "/" + c.Method
+}
+
+func (c *MethodConfig) validate() error {
+	if c.Service == "" {
+		return errors.New("service name is empty")
+	}
+	if c.Retry != nil && c.Hedging != nil {
+		return errors.Errorf("%s: retry and hedging policies are mutually exclusive", c.path())
+	}
+	if c.Retry != nil {
+		if c.Retry.MaxAttempts < 2 {
+			return errors.Errorf("%s: retry max attempts must be at least 2", c.path())
+		}
+		if _, err := parseCodes(c.Retry.RetryableStatusCodes); err != nil {
+			return errors.Wrapf(err, "%s: invalid retryable status codes", c.path())
+		}
+	}
+	if c.Hedging != nil {
+		if c.Hedging.MaxAttempts < 2 {
+			return errors.Errorf("%s: hedging max attempts must be at least 2", c.path())
+		}
+		if _, err := parseCodes(c.Hedging.NonFatalStatusCodes); err != nil {
+			return errors.Wrapf(err, "%s: invalid non fatal status codes", c.path())
+		}
+	}
+	return nil
+}
+
+func parseCodes(names []string) (map[codes.Code]bool, error) {
+	res := make(map[codes.Code]bool, len(names))
+	for _, name := range names {
+		var c codes.Code
+		if err := c.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(name)))); err != nil {
+			return nil, err
+		}
+		res[c] = true
+	}
+	return res, nil
+}
+
+// jsonMethodConfig is method config of grpc service config json.
+type jsonMethodConfig struct {
+	Name         []jsonName       `json:"name"`
+	WaitForReady *bool            `json:"waitForReady,omitempty"`
+	Timeout      string           `json:"timeout,omitempty"`
+	RetryPolicy  *jsonRetryPolicy `json:"retryPolicy,omitempty"`
+}
+
+type jsonName struct {
+	Service string `json:"service"`
+	Method  string `json:"method,omitempty"`
+}
+
+type jsonRetryPolicy struct {
+	MaxAttempts          int      `json:"maxAttempts"`
+	InitialBackoff       string   `json:"initialBackoff"`
+	MaxBackoff           string   `json:"maxBackoff"`
+	BackoffMultiplier    float64  `json:"backoffMultiplier"`
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+}
+
+// jsonDuration formats d as protobuf json duration.
+func jsonDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// serviceConfigJSON builds grpc service config json of methods, hedging policies are left to hedgingPolicies.
+func serviceConfigJSON(methods []MethodConfig) (string, error) {
+	var jsonMethods []jsonMethodConfig
+	for _, m := range methods {
+		jm := jsonMethodConfig{
+			Name: []jsonName{{Service: m.Service, Method: m.Method}},
+		}
+		if m.WaitForReady {
+			waitForReady := true
+			jm.WaitForReady = &waitForReady
+		}
+		if m.Timeout > 0 {
+			jm.Timeout = jsonDuration(m.Timeout)
+		}
+		if m.Retry != nil {
+			statusCodes := make([]string, 0, len(m.Retry.RetryableStatusCodes))
+			for _, c := range m.Retry.RetryableStatusCodes {
+				statusCodes = append(statusCodes, strings.ToUpper(c))
+			}
+			jm.RetryPolicy = &jsonRetryPolicy{
+				MaxAttempts:          m.Retry.MaxAttempts,
+				InitialBackoff:       jsonDuration(m.Retry.InitialBackoff),
+				MaxBackoff:           jsonDuration(m.Retry.MaxBackoff),
+				BackoffMultiplier:    m.Retry.BackoffMultiplier,
+				RetryableStatusCodes: statusCodes,
+			}
+		}
+		jsonMethods = append(jsonMethods, jm)
+	}
+
+	b, err := json.Marshal(struct {
+		MethodConfig []jsonMethodConfig `json:"methodConfig"`
+	}{jsonMethods})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal service config")
+	}
+	if _, err := serviceconfig.Parse(string(b)); err != nil {
+		return "", errors.Wrapf(err, "invalid service config %s", b)
+	}
+
+	return string(b), nil
+}
+
+// serviceConfigOptions returns dial options applying call policies of cfg.
+// Service config is the default one, service config provided by resolver takes precedence over it.
+func (s *Server) serviceConfigOptions(msName string, cfg ClientConfig) ([]grpc.DialOption, error) {
+	if len(cfg.Methods) == 0 {
+		return nil, nil
+	}
+
+	for i := range cfg.Methods {
+		if err := cfg.Methods[i].validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid method config of client %s", msName)
+		}
+	}
+
+	sc, err := serviceConfigJSON(cfg.Methods)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid method config of client %s", msName)
+	}
+	opts := []grpc.DialOption{grpc.WithDefaultServiceConfig(sc)}
+
+	hedging := newHedgingPolicies(cfg.Methods)
+	if hedging != nil {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(hedging.unaryClientInterceptor))
+	}
+
+	for _, m := range cfg.Methods {
+		if m.Retry != nil && os.Getenv(retryEnvVar) != "on" {
+			s.log.Sugar().Warnf("retry policies of client %s are ignored, set %s=on to enable them", msName, retryEnvVar)
+			break
+		}
+	}
+
+	return opts, nil
+}
+
+type hedgingPolicy struct {
+	maxAttempts int
+	delay       time.Duration
+	nonFatal    map[codes.Code]bool
+}
+
+// hedgingPolicies holds hedging policies by full method name or service prefix.
+type hedgingPolicies struct {
+	methods  map[string]*hedgingPolicy
+	services map[string]*hedgingPolicy
+}
+
+func newHedgingPolicies(methods []MethodConfig) *hedgingPolicies {
+	p := &hedgingPolicies{
+		methods:  map[string]*hedgingPolicy{},
+		services: map[string]*hedgingPolicy{},
+	}
+	for _, m := range methods {
+		var policy *hedgingPolicy
+		if m.Hedging != nil {
+			// codes are validated already
+			nonFatal, _ := parseCodes(m.Hedging.NonFatalStatusCodes)
+			policy = &hedgingPolicy{
+				maxAttempts: m.Hedging.MaxAttempts,
+				delay:       *m.Hedging.HedgingDelay,
+				nonFatal:    nonFatal,
+			}
+		}
+		// methods without hedging are kept as nil to override service policy
+		if m.Method == "" {
+			p.services[m.path()] = policy
+		} else {
+			p.methods[m.path()] = policy
+		}
+	}
+
+	for _, policy := range p.methods {
+		if policy != nil {
+			return p
+		}
+	}
+	for _, policy := range p.services {
+		if policy != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *hedgingPolicies) policy(method string) *hedgingPolicy {
+	if policy, ok := p.methods[method]; ok {
+		return policy
+	}
+	if i := strings.LastIndex(method, "/"); i >= 0 {
+		return p.services[method[:i+1]]
+	}
+	return nil
+}
+
+type hedgingResult struct {
+	reply proto.Message
+	err   error
+}
+
+// unaryClientInterceptor sends hedged attempts of calls with hedging policy.
+// Every attempt gets its own reply message, the first successful one is merged into reset reply.
+// Calls with reply other than proto message aren't hedged.
+func (p *hedgingPolicies) unaryClientInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	policy := p.policy(method)
+	msg, ok := reply.(proto.Message)
+	if policy == nil || !ok || reflect.TypeOf(msg).Kind() != reflect.Ptr {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered, so attempts finishing after the result is chosen never block
+	results := make(chan hedgingResult, policy.maxAttempts)
+	var wg sync.WaitGroup
+	sent, pending := 0, 0
+	send := func() {
+		r := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(proto.Message)
+		sent++
+		pending++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- hedgingResult{reply: r, err: invoker(ctx, method, req, r, cc, opts...)}
+		}()
+	}
+	// finish cancels attempts in flight and waits for them, so they don't outlive the call
+	finish := func() {
+		cancel()
+		wg.Wait()
+	}
+
+	send()
+	timer := time.NewTimer(policy.delay)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if sent < policy.maxAttempts {
+				send()
+				timer.Reset(policy.delay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				finish()
+				msg.Reset()
+				proto.Merge(msg, res.reply)
+				return nil
+			}
+			lastErr = res.err
+			if !policy.nonFatal[status.Code(res.err)] {
+				finish()
+				return res.err
+			}
+			// don't wait for hedging delay if there is no attempt in flight
+			if pending == 0 && sent < policy.maxAttempts {
+				send()
+				timer.Reset(policy.delay)
+			}
+		}
+	}
+
+	return lastErr
+}
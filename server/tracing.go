@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+)
+
+// traceGateway wraps grpc gateway handler with server span of the inbound http request.
+// Span is continued from trace headers of the request and propagated to the loopback grpc call by gatewayMetadata.
+func traceGateway(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tracer := opentracing.GlobalTracer()
+		parentSpanContext, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+		if err != nil && err != opentracing.ErrSpanContextNotFound {
+			grpclog.Infof("failed to extract trace context from http request: %v", err)
+		}
+
+		span := tracer.StartSpan("HTTP "+r.Method, ext.RPCServerOption(parentSpanContext), ext.SpanKindRPCServer)
+		defer span.Finish()
+		ext.Component.Set(span, "grpc-gateway")
+		ext.HTTPMethod.Set(span, r.Method)
+		ext.HTTPUrl.Set(span, r.URL.String())
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(opentracing.ContextWithSpan(r.Context(), span)))
+
+		ext.HTTPStatusCode.Set(span, uint16(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			ext.Error.Set(span, true)
+		}
+	}
+}
+
+// gatewayMetadata is runtime.WithMetadata hook that injects span of the http request into outgoing grpc metadata.
+func (s *Server) gatewayMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	debugMD := s.debugMetadata(r)
+
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return debugMD
+	}
+
+	header := http.Header{}
+	if err := opentracing.GlobalTracer().Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)); err != nil {
+		grpclog.Infof("failed to inject trace context into gateway metadata: %v", err)
+		return debugMD
+	}
+
+	md := metadata.MD{}
+	for k, v := range header {
+		md.Append(k, v...)
+	}
+	return metadata.Join(md, debugMD)
+}
@@ -0,0 +1,143 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/uber/jaeger-client-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpc_ctxtags keys holding identifiers of the server span, they are picked up by request logger.
+const (
+	TagTraceID = "trace.traceid"
+	TagSpanID  = "trace.spanid"
+)
+
+var grpcComponentTag = opentracing.Tag{Key: string(ext.Component), Value: "gRPC"}
+
+// SpanConfig configures enrichment of server spans.
+type SpanConfig struct {
+	// Fields is a list of grpc_ctxtags keys copied to span tags, e.g. grpc.request.user_id.
+	// No tags are copied if empty, as tags may hold personal data of request.
+	Fields []string
+	// Peer adds address of the caller as peer.address tag.
+	Peer bool
+	// SubjectField is grpc_ctxtags key holding authenticated subject, it is copied to auth.subject tag.
+	SubjectField string
+	// StatusDetails adds details of grpc status to error logs.
+	StatusDetails bool
+}
+
+// UnaryServerInterceptor starts server span continuing trace from incoming metadata and enriches it according to cfg.
+// It must be placed after grpc_ctxtags interceptor.
+func UnaryServerInterceptor(cfg SpanConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		tracer := opentracing.GlobalTracer()
+		md, _ := metadata.FromIncomingContext(ctx)
+		parentSpanContext, err := tracer.Extract(opentracing.HTTPHeaders, metadataCarrier(md))
+		if err != nil && err != opentracing.ErrSpanContextNotFound {
+			grpclog.Infof("failed to extract trace context from grpc metadata: %v", err)
+		}
+
+		span := tracer.StartSpan(info.FullMethod, ext.RPCServerOption(parentSpanContext), grpcComponentTag)
+		tags := grpc_ctxtags.Extract(ctx)
+		if sc, ok := span.Context().(jaeger.SpanContext); ok {
+			tags.Set(TagTraceID, sc.TraceID().String()).Set(TagSpanID, sc.SpanID().String())
+		}
+		if cfg.Peer {
+			if p, ok := peer.FromContext(ctx); ok {
+				span.SetTag("peer.address", p.Addr.String())
+			}
+		}
+
+		resp, err := handler(opentracing.ContextWithSpan(ctx, span), req)
+		finishServerSpan(span, tags, cfg, err)
+		return resp, err
+	}
+}
+
+func finishServerSpan(span opentracing.Span, tags grpc_ctxtags.Tags, cfg SpanConfig, err error) {
+	values := tags.Values()
+	for _, k := range cfg.Fields {
+		if v, ok := values[k]; ok {
+			setTag(span, k, v)
+		}
+	}
+	if cfg.SubjectField != "" {
+		if v, ok := values[cfg.SubjectField]; ok {
+			span.SetTag("auth.subject", v)
+		}
+	}
+
+	st := status.Convert(err)
+	span.SetTag("grpc.code", st.Code().String())
+	if err != nil {
+		ext.Error.Set(span, true)
+		fields := []log.Field{
+			log.String("event", "error"),
+			log.String("grpc.code", st.Code().String()),
+			log.String("message", st.Message()),
+		}
+		if cfg.StatusDetails {
+			for _, d := range st.Details() {
+				fields = append(fields, log.String("grpc.details", fmt.Sprintf("%v", d)))
+			}
+		}
+		span.LogFields(fields...)
+	}
+
+	span.Finish()
+}
+
+func setTag(span opentracing.Span, k string, v interface{}) {
+	// errors are logged rather than tagged
+	if vErr, ok := v.(error); ok {
+		span.LogKV(k, vErr.Error())
+		return
+	}
+	span.SetTag(k, v)
+}
+
+// metadataCarrier is opentracing.TextMapReader and opentracing.TextMapWriter over grpc metadata.
+type metadataCarrier metadata.MD
+
+func (m metadataCarrier) Set(key, val string) {
+	key = strings.ToLower(key)
+	m[key] = append(m[key], val)
+}
+
+func (m metadataCarrier) ForeachKey(handler func(key, val string) error) error {
+	for k, vv := range m {
+		for _, v := range vv {
+			if err := handler(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SampledTraceID returns id of the trace of span from ctx if the trace is sampled.
+func SampledTraceID(ctx context.Context) (string, bool) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return "", false
+	}
+
+	sc, ok := span.Context().(jaeger.SpanContext)
+	if !ok || !sc.IsSampled() {
+		return "", false
+	}
+
+	return sc.TraceID().String(), true
+}
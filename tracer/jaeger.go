@@ -4,17 +4,20 @@ import (
 	"io"
 
 	"github.com/humans-net/grpc-core/config"
+	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	jaegercfg "github.com/uber/jaeger-client-go/config"
 	jaeger_zap "github.com/uber/jaeger-client-go/log/zap"
 	jaegerprometheus "github.com/uber/jaeger-lib/metrics/prometheus"
 	"go.uber.org/zap"
 )
 
-func InitJaeger(serviceName string, loader config.Loader, l *zap.Logger) (io.Closer,
+func InitJaeger(serviceName string, loader config.Loader, l *zap.Logger, reg prometheus.Registerer) (io.Closer,
 	error) {
 	cfg := jaegercfg.Configuration{}
 	samplerConfig := SamplerConfig{}
+	propagationConfig := PropagationConfig{}
 	if err := loader.Load("Jaeger", &cfg); err != nil {
 		l.Sugar().Infof("jaeger disabled: %v", err)
 		return nil, nil
@@ -24,7 +27,7 @@ func InitJaeger(serviceName string, loader config.Loader, l *zap.Logger) (io.Clo
 		l.Sugar().Info("TracerSampler disabled: %v")
 	}
 
-	metricsFactory := jaegerprometheus.New()
+	metricsFactory := jaegerprometheus.New(jaegerprometheus.WithRegisterer(reg))
 
 	options := []jaegercfg.Option{
 		jaegercfg.Metrics(metricsFactory),
@@ -32,14 +35,43 @@ func InitJaeger(serviceName string, loader config.Loader, l *zap.Logger) (io.Clo
 	}
 
 	if samplerConfig.Enabled {
-		sampler, err := NewOperationProbabilisticSampler(samplerConfig.Default, samplerConfig.Operations)
+		sampler, err := NewReloadableSampler(samplerConfig, reg)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to create sampler")
 		}
 
+		loader.Watch("TracerSampler", func() {
+			cfg := SamplerConfig{}
+			if err := loader.Load("TracerSampler", &cfg); err != nil {
+				l.Sugar().Errorf("failed to reload TracerSampler, keeping previous one: %v", err)
+				return
+			}
+			if err := sampler.Update(cfg); err != nil {
+				l.Sugar().Errorf("failed to update sampler, keeping previous one: %v", err)
+				return
+			}
+			l.Sugar().Infof("TracerSampler reloaded")
+		})
+
 		options = append(options, jaegercfg.Sampler(sampler))
 	}
 
+	if err := loader.Load("TracerPropagation", &propagationConfig); err != nil {
+		l.Sugar().Infof("TracerPropagation disabled, using jaeger headers only: %v", err)
+	} else {
+		propagator, err := NewPropagator(propagationConfig, cfg.Headers)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create propagator")
+		}
+
+		// grpc metadata and gateway http headers are both carried as opentracing.HTTPHeaders,
+		// TextMap codec stays jaeger one, so baggage of TextMap carriers isn't escaped
+		options = append(options,
+			jaegercfg.Injector(opentracing.HTTPHeaders, propagator),
+			jaegercfg.Extractor(opentracing.HTTPHeaders, propagator),
+		)
+	}
+
 	closer, err := cfg.InitGlobalTracer(serviceName, options...)
 	if err != nil {
 		l.Sugar().Panicf("failed to init jaeger: %v", err)
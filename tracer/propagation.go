@@ -0,0 +1,359 @@
+package tracer
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-client-go/zipkin"
+)
+
+// Supported trace context propagation formats.
+const (
+	PropagatorJaeger   = "jaeger"
+	PropagatorW3C      = "w3c"
+	PropagatorB3       = "b3"
+	PropagatorB3Single = "b3single"
+	PropagatorBaggage  = "baggage"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	b3SingleHeader    = "b3"
+	baggageHeader     = "baggage"
+)
+
+// PropagationConfig holds configuration of trace context propagation.
+type PropagationConfig struct {
+	// Propagators is an ordered list of formats used for trace context propagation.
+	// Context is injected in every listed format and extracted from the first one found in the carrier.
+	// Supported values are jaeger, w3c, b3, b3single and baggage.
+	Propagators []string
+}
+
+// Propagator is a combined jaeger.Injector and jaeger.Extractor.
+type Propagator interface {
+	jaeger.Injector
+	jaeger.Extractor
+}
+
+// NewPropagator creates composite Propagator for formats listed in cfg.
+// Headers are used by jaeger format, nil means default jaeger headers.
+func NewPropagator(cfg PropagationConfig, headers *jaeger.HeadersConfig) (Propagator, error) {
+	if headers == nil {
+		headers = &jaeger.HeadersConfig{}
+	}
+	headers.ApplyDefaults()
+
+	composite := &CompositePropagator{}
+	for _, name := range cfg.Propagators {
+		var p Propagator
+		switch strings.ToLower(name) {
+		case PropagatorJaeger:
+			p = jaeger.NewHTTPHeaderPropagator(headers, *jaeger.NewNullMetrics())
+		case PropagatorW3C:
+			p = W3CPropagator{}
+		case PropagatorB3:
+			p = zipkin.NewZipkinB3HTTPHeaderPropagator()
+		case PropagatorB3Single:
+			p = B3SinglePropagator{}
+		case PropagatorBaggage:
+			p = BaggagePropagator{}
+		default:
+			return nil, errors.Errorf("unknown propagator %q", name)
+		}
+
+		composite.propagators = append(composite.propagators, p)
+	}
+
+	if len(composite.propagators) == 0 {
+		return nil, errors.New("no propagators configured")
+	}
+
+	return composite, nil
+}
+
+// CompositePropagator injects span context with all of its propagators
+// and extracts it with the first propagator that finds a valid one in the carrier.
+// Baggage found by other propagators is merged into the extracted context.
+type CompositePropagator struct {
+	propagators []Propagator
+}
+
+// Inject implements jaeger.Injector.
+func (c *CompositePropagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	for _, p := range c.propagators {
+		if err := p.Inject(sc, carrier); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Extract implements jaeger.Extractor.
+func (c *CompositePropagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	var (
+		result   jaeger.SpanContext
+		fallback *jaeger.SpanContext
+		baggage  = map[string]string{}
+		lastErr  error
+	)
+
+	for _, p := range c.propagators {
+		sc, err := p.Extract(carrier)
+		if err == opentracing.ErrInvalidCarrier {
+			return jaeger.SpanContext{}, err
+		}
+		if err != nil {
+			// malformed headers of one format must not break extraction of the others
+			if err != opentracing.ErrSpanContextNotFound {
+				lastErr = err
+			}
+			continue
+		}
+
+		sc.ForeachBaggageItem(func(k, v string) bool {
+			if _, ok := baggage[k]; !ok {
+				baggage[k] = v
+			}
+			return true
+		})
+
+		if sc.IsValid() && !result.IsValid() {
+			result = sc
+		} else if !sc.IsValid() && fallback == nil {
+			// jaeger propagator returns context with debug id only, keep it if nothing better is found
+			sc := sc
+			fallback = &sc
+		}
+	}
+
+	if !result.IsValid() {
+		if fallback != nil {
+			return *fallback, nil
+		}
+		if lastErr != nil {
+			return jaeger.SpanContext{}, lastErr
+		}
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+
+	for k, v := range baggage {
+		result = result.WithBaggageItem(k, v)
+	}
+
+	return result, nil
+}
+
+// W3CPropagator propagates span context in W3C Trace Context traceparent header.
+type W3CPropagator struct{}
+
+// Inject implements jaeger.Injector.
+func (W3CPropagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	w, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+
+	flags := 0
+	if sc.IsSampled() {
+		flags = 1
+	}
+	traceID := sc.TraceID()
+	w.Set(traceparentHeader, fmt.Sprintf("00-%016x%016x-%016x-%02x", traceID.High, traceID.Low, uint64(sc.SpanID()), flags))
+	return nil
+}
+
+// Extract implements jaeger.Extractor.
+func (W3CPropagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	r, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return jaeger.SpanContext{}, opentracing.ErrInvalidCarrier
+	}
+
+	var value string
+	if err := r.ForeachKey(func(key, val string) error {
+		if strings.ToLower(key) == traceparentHeader {
+			value = val
+		}
+		return nil
+	}); err != nil {
+		return jaeger.SpanContext{}, err
+	}
+	if value == "" {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return jaeger.SpanContext{}, errors.Errorf("malformed traceparent header %q", value)
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return jaeger.SpanContext{}, errors.Errorf("unsupported traceparent version in %q", value)
+	}
+
+	traceID, err := jaeger.TraceIDFromString(parts[1])
+	if err != nil {
+		return jaeger.SpanContext{}, errors.Wrapf(err, "malformed trace id in traceparent header %q", value)
+	}
+	spanID, err := jaeger.SpanIDFromString(parts[2])
+	if err != nil {
+		return jaeger.SpanContext{}, errors.Wrapf(err, "malformed span id in traceparent header %q", value)
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return jaeger.SpanContext{}, errors.Wrapf(err, "malformed flags in traceparent header %q", value)
+	}
+	if !traceID.IsValid() || spanID == 0 {
+		return jaeger.SpanContext{}, errors.Errorf("zero trace or span id in traceparent header %q", value)
+	}
+
+	return jaeger.NewSpanContext(traceID, spanID, 0, flags&1 == 1, nil), nil
+}
+
+// B3SinglePropagator propagates span context in single b3 header.
+type B3SinglePropagator struct{}
+
+// Inject implements jaeger.Injector.
+func (B3SinglePropagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	w, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+	traceID := fmt.Sprintf("%016x", sc.TraceID().Low)
+	if sc.TraceID().High != 0 {
+		traceID = fmt.Sprintf("%016x%s", sc.TraceID().High, traceID)
+	}
+	value := fmt.Sprintf("%s-%016x-%s", traceID, uint64(sc.SpanID()), sampled)
+	if sc.ParentID() != 0 {
+		value += fmt.Sprintf("-%016x", uint64(sc.ParentID()))
+	}
+	w.Set(b3SingleHeader, value)
+	return nil
+}
+
+// Extract implements jaeger.Extractor.
+func (B3SinglePropagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	r, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return jaeger.SpanContext{}, opentracing.ErrInvalidCarrier
+	}
+
+	var value string
+	if err := r.ForeachKey(func(key, val string) error {
+		if strings.ToLower(key) == b3SingleHeader {
+			value = val
+		}
+		return nil
+	}); err != nil {
+		return jaeger.SpanContext{}, err
+	}
+	if value == "" {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+
+	// traceid-spanid-sampled-parentspanid, where sampled and parent are optional
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		// single sampling decision without ids, e.g. "0" or "d", does not carry context
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+
+	traceID, err := jaeger.TraceIDFromString(parts[0])
+	if err != nil {
+		return jaeger.SpanContext{}, errors.Wrapf(err, "malformed trace id in b3 header %q", value)
+	}
+	spanID, err := jaeger.SpanIDFromString(parts[1])
+	if err != nil {
+		return jaeger.SpanContext{}, errors.Wrapf(err, "malformed span id in b3 header %q", value)
+	}
+
+	sampled := false
+	if len(parts) > 2 {
+		sampled = parts[2] == "1" || parts[2] == "d"
+	}
+
+	var parentID jaeger.SpanID
+	if len(parts) > 3 {
+		if parentID, err = jaeger.SpanIDFromString(parts[3]); err != nil {
+			return jaeger.SpanContext{}, errors.Wrapf(err, "malformed parent span id in b3 header %q", value)
+		}
+	}
+	if !traceID.IsValid() {
+		return jaeger.SpanContext{}, errors.Errorf("zero trace id in b3 header %q", value)
+	}
+
+	return jaeger.NewSpanContext(traceID, spanID, parentID, sampled, nil), nil
+}
+
+// BaggagePropagator propagates baggage items in W3C baggage header.
+// It does not carry trace identity, extracted context holds baggage only.
+type BaggagePropagator struct{}
+
+// Inject implements jaeger.Injector.
+func (BaggagePropagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	w, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+
+	var items []string
+	sc.ForeachBaggageItem(func(k, v string) bool {
+		items = append(items, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		return true
+	})
+	if len(items) > 0 {
+		w.Set(baggageHeader, strings.Join(items, ","))
+	}
+	return nil
+}
+
+// Extract implements jaeger.Extractor.
+func (BaggagePropagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	r, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return jaeger.SpanContext{}, opentracing.ErrInvalidCarrier
+	}
+
+	baggage := map[string]string{}
+	if err := r.ForeachKey(func(key, val string) error {
+		if strings.ToLower(key) != baggageHeader {
+			return nil
+		}
+		for _, item := range strings.Split(val, ",") {
+			// properties after ';' are not supported and dropped
+			kv := strings.SplitN(strings.SplitN(item, ";", 2)[0], "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			k, err := url.QueryUnescape(strings.TrimSpace(kv[0]))
+			if err != nil {
+				continue
+			}
+			v, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+			if err != nil {
+				continue
+			}
+			baggage[k] = v
+		}
+		return nil
+	}); err != nil {
+		return jaeger.SpanContext{}, err
+	}
+	if len(baggage) == 0 {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+
+	return jaeger.NewSpanContext(jaeger.TraceID{}, 0, 0, false, baggage), nil
+}
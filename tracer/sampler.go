@@ -1,10 +1,29 @@
 package tracer
 
 import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uber/jaeger-client-go"
 )
 
+// Sampling rule types.
+const (
+	// RuleProbabilistic samples operation with probability Rate.
+	RuleProbabilistic = "probabilistic"
+	// RuleRateLimiting samples at most MaxTracesPerSecond traces per second.
+	RuleRateLimiting = "ratelimiting"
+	// RuleGuaranteed samples operation with probability Rate, but not less than MaxTracesPerSecond traces per second.
+	RuleGuaranteed = "guaranteed"
+)
+
 // SamplerConfig holds configuration for OperationProbabilisticSampler.
 type SamplerConfig struct {
 	// Enabled if sampler enabled.
@@ -13,19 +32,47 @@ type SamplerConfig struct {
 	Default float64
 	// Operations is per operation probabilistic rate override.
 	Operations map[string]float64
+	// Rules is per operation sampling strategy override, it takes precedence over Operations.
+	Rules []SamplingRule
+}
+
+// SamplingRule configures sampling strategy for operations.
+type SamplingRule struct {
+	// Operation is operation name, name ending with '*' matches all operations with such prefix.
+	// Operations matching the same rule share its rate limit.
+	Operation string `validate:"nonzero"`
+	// Type is one of probabilistic (default), ratelimiting or guaranteed.
+	Type string
+	// Rate is sampling probability for probabilistic and guaranteed rules.
+	Rate float64
+	// MaxTracesPerSecond is rate limit for ratelimiting rules and lower bound for guaranteed rules.
+	MaxTracesPerSecond float64
 }
 
-// OperationProbabilisticSampler is an implementation of jaeger.Sampler interface that allows to specify sampling rate for operations.
-// If no concrete rate is set for operation then default one is used.
+// OperationProbabilisticSampler is an implementation of jaeger.Sampler interface that allows to specify sampling strategy for operations.
+// If no concrete rule is set for operation then default probabilistic rate is used.
 type OperationProbabilisticSampler struct {
+	cfg            SamplerConfig
 	samplers       map[string]jaeger.Sampler
+	prefixes       []prefixSampler
 	defaultSampler jaeger.Sampler
+	metrics        *samplerMetrics
+}
+
+type prefixSampler struct {
+	prefix  string
+	sampler jaeger.Sampler
 }
 
 // NewOperationProbabilisticSampler creates new OperationProbabilisticSampler.
 func NewOperationProbabilisticSampler(defaultRate float64, rates map[string]float64) (*OperationProbabilisticSampler, error) {
-	samplers := make(map[string]jaeger.Sampler, len(rates))
-	for operation, rate := range rates {
+	return NewOperationSampler(SamplerConfig{Enabled: true, Default: defaultRate, Operations: rates})
+}
+
+// NewOperationSampler creates new OperationProbabilisticSampler from rates and rules of cfg.
+func NewOperationSampler(cfg SamplerConfig) (*OperationProbabilisticSampler, error) {
+	samplers := make(map[string]jaeger.Sampler, len(cfg.Operations)+len(cfg.Rules))
+	for operation, rate := range cfg.Operations {
 		sampler, err := jaeger.NewProbabilisticSampler(rate)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to create sampler for operation %q", operation)
@@ -34,28 +81,82 @@ func NewOperationProbabilisticSampler(defaultRate float64, rates map[string]floa
 		samplers[operation] = sampler
 	}
 
-	defSampler, err := jaeger.NewProbabilisticSampler(defaultRate)
+	var prefixes []prefixSampler
+	for _, rule := range cfg.Rules {
+		sampler, err := newRuleSampler(rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create sampler for operation %q", rule.Operation)
+		}
+
+		if strings.HasSuffix(rule.Operation, "*") {
+			prefixes = append(prefixes, prefixSampler{prefix: strings.TrimSuffix(rule.Operation, "*"), sampler: sampler})
+			continue
+		}
+		samplers[rule.Operation] = sampler
+	}
+	// the most specific prefix wins
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return len(prefixes[i].prefix) > len(prefixes[j].prefix)
+	})
+
+	defSampler, err := jaeger.NewProbabilisticSampler(cfg.Default)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create default sampler")
 	}
 
 	return &OperationProbabilisticSampler{
+		cfg:            cfg,
 		defaultSampler: defSampler,
 		samplers:       samplers,
+		prefixes:       prefixes,
 	}, nil
 }
 
+func newRuleSampler(rule SamplingRule) (jaeger.Sampler, error) {
+	switch strings.ToLower(rule.Type) {
+	case "", RuleProbabilistic:
+		return jaeger.NewProbabilisticSampler(rule.Rate)
+	case RuleRateLimiting:
+		if rule.MaxTracesPerSecond < 0 {
+			return nil, errors.Errorf("negative max traces per second %v", rule.MaxTracesPerSecond)
+		}
+		return jaeger.NewRateLimitingSampler(rule.MaxTracesPerSecond), nil
+	case RuleGuaranteed:
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return nil, errors.Errorf("sampling rate must be between 0.0 and 1.0, received %v", rule.Rate)
+		}
+		if rule.MaxTracesPerSecond < 0 {
+			return nil, errors.Errorf("negative max traces per second %v", rule.MaxTracesPerSecond)
+		}
+		return jaeger.NewGuaranteedThroughputProbabilisticSampler(rule.MaxTracesPerSecond, rule.Rate)
+	default:
+		return nil, errors.Errorf("unknown sampling rule type %q", rule.Type)
+	}
+}
+
 // IsSampled decides whether a trace with given `id` and `operation`
 // should be sampled. This function will also return the tags that
 // can be used to identify the type of sampling that was applied to
 // the root span. Most simple samplers would return two tags,
 // sampler.type and sampler.param, similar to those used in the Configuration
 func (s *OperationProbabilisticSampler) IsSampled(id jaeger.TraceID, operation string) (sampled bool, tags []jaeger.Tag) {
+	sampled, tags = s.samplerFor(operation).IsSampled(id, operation)
+	s.metrics.observe(operation, sampled)
+	return sampled, tags
+}
+
+func (s *OperationProbabilisticSampler) samplerFor(operation string) jaeger.Sampler {
 	if sampler, exists := s.samplers[operation]; exists {
-		return sampler.IsSampled(id, operation)
+		return sampler
 	}
 
-	return s.defaultSampler.IsSampled(id, operation)
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(operation, p.prefix) {
+			return p.sampler
+		}
+	}
+
+	return s.defaultSampler
 }
 
 // Close does a clean shutdown of the sampler, stopping any background
@@ -65,10 +166,135 @@ func (s *OperationProbabilisticSampler) Close() {
 	for _, sampler := range s.samplers {
 		sampler.Close()
 	}
+	for _, p := range s.prefixes {
+		p.sampler.Close()
+	}
 }
 
 // Equal checks if the `other` sampler is functionally equivalent
 // to this sampler.
 func (s *OperationProbabilisticSampler) Equal(other jaeger.Sampler) bool {
-	return false
+	o, ok := other.(*OperationProbabilisticSampler)
+	if !ok {
+		return false
+	}
+
+	return reflect.DeepEqual(s.cfg, o.cfg)
+}
+
+// ReloadableSampler is jaeger.Sampler that delegates to OperationProbabilisticSampler
+// which is atomically swapped on configuration change.
+type ReloadableSampler struct {
+	// lock serializes updates, IsSampled is lock free
+	lock    sync.Mutex
+	sampler atomic.Value
+	metrics *samplerMetrics
+}
+
+// NewReloadableSampler creates ReloadableSampler from cfg.
+// Sampling decisions are reported to reg, nil reg disables metrics.
+func NewReloadableSampler(cfg SamplerConfig, reg prometheus.Registerer) (*ReloadableSampler, error) {
+	metrics, err := newSamplerMetrics(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ReloadableSampler{metrics: metrics}
+	if err := s.Update(cfg); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Update replaces current sampler by the one created from cfg, sampler is kept as is in case of error.
+func (s *ReloadableSampler) Update(cfg SamplerConfig) error {
+	sampler, err := NewOperationSampler(cfg)
+	if err != nil {
+		return err
+	}
+	sampler.metrics = s.metrics
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old := s.current(); old != nil {
+		if old.Equal(sampler) {
+			sampler.Close()
+			return nil
+		}
+		defer old.Close()
+	}
+	s.sampler.Store(sampler)
+
+	return nil
+}
+
+func (s *ReloadableSampler) current() *OperationProbabilisticSampler {
+	sampler, _ := s.sampler.Load().(*OperationProbabilisticSampler)
+	return sampler
+}
+
+// IsSampled implements jaeger.Sampler.
+func (s *ReloadableSampler) IsSampled(id jaeger.TraceID, operation string) (sampled bool, tags []jaeger.Tag) {
+	return s.current().IsSampled(id, operation)
+}
+
+// Close implements jaeger.Sampler.
+func (s *ReloadableSampler) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.current().Close()
+}
+
+// Equal implements jaeger.Sampler.
+func (s *ReloadableSampler) Equal(other jaeger.Sampler) bool {
+	if o, ok := other.(*ReloadableSampler); ok {
+		return s.current().Equal(o.current())
+	}
+
+	return s.current().Equal(other)
+}
+
+type samplerMetrics struct {
+	decisions *prometheus.CounterVec
+}
+
+func newSamplerMetrics(reg prometheus.Registerer) (*samplerMetrics, error) {
+	if reg == nil {
+		return nil, nil
+	}
+
+	decisions := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tracer",
+		Subsystem: "sampler",
+		Name:      "decisions_total",
+		Help:      "Total number of sampling decisions made per operation.",
+	}, []string{"operation", "sampled"})
+	if err := reg.Register(decisions); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, errors.Wrap(err, "failed to register sampler metrics")
+		}
+		decisions = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+
+	return &samplerMetrics{decisions: decisions}, nil
+}
+
+func (m *samplerMetrics) observe(operation string, sampled bool) {
+	if m == nil {
+		return
+	}
+
+	label := "false"
+	if sampled {
+		label = "true"
+	}
+	m.decisions.WithLabelValues(operation, label).Inc()
+}
+
+// ForceSampling marks span and its trace as debug one, sampling it regardless of OperationProbabilisticSampler decision.
+func ForceSampling(span opentracing.Span) {
+	ext.SamplingPriority.Set(span, 1)
 }